@@ -0,0 +1,250 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// AccessRecord describes a finished session.
+type AccessRecord struct {
+	SessionID           string
+	StartTime           time.Time
+	Duration            time.Duration
+	ClientAddress       string
+	Username            string
+	Command             Command
+	Destination         string
+	ResolvedDestination string
+	Reply               byte
+	Replied             bool
+	UploadBytes         int64
+	DownloadBytes       int64
+	CloseReason         string
+}
+
+// AccessLogger is called once for every finished CONNECT, UDP ASSOCIATE
+// or BIND request, including the requests that were rejected.
+type AccessLogger interface {
+	LogAccess(ctx context.Context, record AccessRecord)
+}
+
+type nopAccessLogger struct{}
+
+func (l *nopAccessLogger) LogAccess(_ context.Context, _ AccessRecord) {}
+
+// NewJSONAccessLogger returns an AccessLogger that writes one JSON object per line to w.
+func NewJSONAccessLogger(w io.Writer) AccessLogger {
+	return &jsonAccessLogger{writer: w}
+}
+
+type jsonAccessLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+type jsonAccessRecord struct {
+	SessionID           string    `json:"session_id"`
+	StartTime           time.Time `json:"start_time"`
+	Duration            float64   `json:"duration"`
+	ClientAddress       string    `json:"client"`
+	Username            string    `json:"user,omitempty"`
+	Command             string    `json:"command"`
+	Destination         string    `json:"destination"`
+	ResolvedDestination string    `json:"resolved,omitempty"`
+	Reply               string    `json:"reply,omitempty"`
+	ReplyCode           *byte     `json:"reply_code,omitempty"`
+	UploadBytes         int64     `json:"upload_bytes"`
+	DownloadBytes       int64     `json:"download_bytes"`
+	CloseReason         string    `json:"close_reason"`
+}
+
+func (l *jsonAccessLogger) LogAccess(_ context.Context, record AccessRecord) {
+	line := jsonAccessRecord{
+		SessionID:           record.SessionID,
+		StartTime:           record.StartTime,
+		Duration:            record.Duration.Seconds(),
+		ClientAddress:       record.ClientAddress,
+		Username:            record.Username,
+		Command:             record.Command.String(),
+		Destination:         record.Destination,
+		ResolvedDestination: record.ResolvedDestination,
+		UploadBytes:         record.UploadBytes,
+		DownloadBytes:       record.DownloadBytes,
+		CloseReason:         record.CloseReason,
+	}
+
+	if record.Replied {
+		line.Reply = replyName(record.Reply)
+		line.ReplyCode = &record.Reply
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	l.writer.Write(append(data, '\n'))
+	l.mutex.Unlock()
+}
+
+// NewSquidAccessLogger returns an AccessLogger that writes records in the
+// Squid native access.log format:
+//
+//	time elapsed client result/reply bytes command destination user hierarchy/resolved type close_reason
+//
+// The reply is the SOCKS reply code and bytes is the sum of both directions.
+func NewSquidAccessLogger(w io.Writer) AccessLogger {
+	return &squidAccessLogger{writer: w}
+}
+
+type squidAccessLogger struct {
+	mutex  sync.Mutex
+	writer io.Writer
+}
+
+func (l *squidAccessLogger) LogAccess(_ context.Context, record AccessRecord) {
+	client := record.ClientAddress
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	reply := "-"
+	if record.Replied {
+		reply = fmt.Sprintf("%03d", record.Reply)
+	}
+
+	hierarchy := "HIER_NONE/-"
+	if record.ResolvedDestination != "" {
+		hierarchy = "HIER_DIRECT/" + record.ResolvedDestination
+	}
+
+	line := fmt.Sprintf("%d.%03d %6d %s %s/%s %d %s %s %s %s - %s\n",
+		record.StartTime.Unix(),
+		record.StartTime.Nanosecond()/int(time.Millisecond),
+		record.Duration.Milliseconds(),
+		dashIfEmpty(client),
+		squidResult(record.Command),
+		reply,
+		record.UploadBytes+record.DownloadBytes,
+		strings.ToUpper(record.Command.String()),
+		dashIfEmpty(record.Destination),
+		dashIfEmpty(record.Username),
+		hierarchy,
+		dashIfEmpty(record.CloseReason),
+	)
+
+	l.mutex.Lock()
+	io.WriteString(l.writer, line)
+	l.mutex.Unlock()
+}
+
+func squidResult(command Command) string {
+	switch command {
+	case Connect:
+		return "TCP_TUNNEL"
+	case Bind:
+		return "TCP_BIND"
+	case UDPAssociate:
+		return "UDP_ASSOCIATE"
+	default:
+		return "NONE"
+	}
+}
+
+func dashIfEmpty(v string) string {
+	if v == "" {
+		return "-"
+	}
+
+	return v
+}
+
+// AccessLogFile is an append-only log file that is reopened when the process
+// receives SIGHUP, so that it can be rotated by tools such as logrotate.
+type AccessLogFile struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	signals chan os.Signal
+	done    chan struct{}
+	once    sync.Once
+}
+
+func OpenAccessLogFile(path string) (*AccessLogFile, error) {
+	file, err := openAppendFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &AccessLogFile{
+		path:    path,
+		file:    file,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan struct{}),
+	}
+
+	signal.Notify(f.signals, syscall.SIGHUP)
+
+	go f.reopenOnSignal()
+
+	return f, nil
+}
+
+func (f *AccessLogFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Write(p)
+}
+
+// Reopen closes the file and opens the path again.
+func (f *AccessLogFile) Reopen() error {
+	file, err := openAppendFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	old := f.file
+	f.file = file
+	f.mutex.Unlock()
+
+	return old.Close()
+}
+
+func (f *AccessLogFile) Close() error {
+	f.once.Do(func() {
+		signal.Stop(f.signals)
+		close(f.done)
+	})
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.file.Close()
+}
+
+func (f *AccessLogFile) reopenOnSignal() {
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-f.signals:
+			f.Reopen()
+		}
+	}
+}
+
+func openAppendFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testAccessRecord = AccessRecord{
+	SessionID:           "ABCDEF",
+	StartTime:           time.Date(2024, 3, 7, 16, 12, 19, 250*int(time.Millisecond), time.UTC),
+	Duration:            1500 * time.Millisecond,
+	ClientAddress:       "127.0.0.1:50000",
+	Username:            "root",
+	Command:             Connect,
+	Destination:         "localhost:5444",
+	ResolvedDestination: "127.0.0.1:5444",
+	Reply:               connectionSuccessful,
+	Replied:             true,
+	UploadBytes:         100,
+	DownloadBytes:       200,
+	CloseReason:         CloseReasonCompleted,
+}
+
+func TestJSONAccessLogger(t *testing.T) {
+	var buff bytes.Buffer
+
+	NewJSONAccessLogger(&buff).LogAccess(context.Background(), testAccessRecord)
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buff.Bytes(), &record))
+
+	assert.Equal(t, map[string]any{
+		"session_id":     "ABCDEF",
+		"start_time":     "2024-03-07T16:12:19.25Z",
+		"duration":       1.5,
+		"client":         "127.0.0.1:50000",
+		"user":           "root",
+		"command":        "connect",
+		"destination":    "localhost:5444",
+		"resolved":       "127.0.0.1:5444",
+		"reply":          "succeeded",
+		"reply_code":     float64(0),
+		"upload_bytes":   float64(100),
+		"download_bytes": float64(200),
+		"close_reason":   "completed",
+	}, record)
+}
+
+func TestSquidAccessLogger(t *testing.T) {
+	var buff bytes.Buffer
+
+	logger := NewSquidAccessLogger(&buff)
+
+	logger.LogAccess(context.Background(), testAccessRecord)
+	logger.LogAccess(context.Background(), AccessRecord{
+		StartTime:     testAccessRecord.StartTime,
+		ClientAddress: "[::1]:50000",
+		Command:       UDPAssociate,
+		Destination:   "0.0.0.0:0",
+		Reply:         connectionNotAllowedByRuleSet,
+		Replied:       true,
+		CloseReason:   CloseReasonDenied,
+	})
+
+	assert.Equal(t,
+		"1709827939.250   1500 127.0.0.1 TCP_TUNNEL/000 300 CONNECT localhost:5444 root HIER_DIRECT/127.0.0.1:5444 - completed\n"+
+			"1709827939.250      0 ::1 UDP_ASSOCIATE/002 0 UDP_ASSOCIATE 0.0.0.0:0 - HIER_NONE/- - denied\n",
+		buff.String(),
+	)
+}
+
+func TestAccessLogFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	file, err := OpenAccessLogFile(path)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		file.Close()
+	})
+
+	_, err = file.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, file.Reopen())
+
+	_, err = file.Write([]byte("second\n"))
+	require.NoError(t, err)
+
+	rotated, err := os.ReadFile(path + ".1")
+	require.NoError(t, err)
+
+	current, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "first\n", string(rotated))
+	assert.Equal(t, "second\n", string(current))
+}
+
+func TestAccessLogFileCloseTwice(t *testing.T) {
+	file, err := OpenAccessLogFile(filepath.Join(t.TempDir(), "access.log"))
+	require.NoError(t, err)
+
+	require.NoError(t, file.Close())
+
+	assert.NotPanics(t, func() {
+		file.Close()
+	})
+}
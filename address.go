@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
@@ -26,6 +27,56 @@ func (a address) String() string {
 	return fmt.Sprintf("%s:%s", a.Domain, a.Port)
 }
 
+// parseAddress encodes a host:port in the address type that fits the host.
+func parseAddress(hostport string) (*address, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	portNum, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := &address{
+		Port: make(port, 2),
+	}
+
+	binary.BigEndian.PutUint16(addr.Port, uint16(portNum))
+
+	ip := net.ParseIP(host)
+
+	switch {
+	case ip.To4() != nil:
+		addr.Type = addressTypeIPv4
+		addr.IP = ip.To4()
+	case ip != nil:
+		addr.Type = addressTypeIPv6
+		addr.IP = ip
+	case len(host) > 255:
+		return nil, errors.New("domain name is too long")
+	default:
+		addr.Type = addressTypeFQDN
+		addr.Domain = []byte(host)
+		addr.DomainLen = byte(len(host))
+	}
+
+	return addr, nil
+}
+
+// addressFromNetAddr returns the protocol address of an IP address and port.
+func addressFromNetAddr(addr net.Addr) (*address, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return parseAddress(net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+	case *net.TCPAddr:
+		return parseAddress(net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+	default:
+		return parseAddress(addr.String())
+	}
+}
+
 func (a address) getDomainOrIP() string {
 	if a.IP != nil {
 		return a.IP.String()
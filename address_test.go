@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := map[string]struct {
+		hostport  string
+		addrType  byte
+		errString string
+	}{
+		"IPv4_address": {
+			hostport: "127.0.0.1:80",
+			addrType: addressTypeIPv4,
+		},
+		"IPv6_address": {
+			hostport: "[::1]:80",
+			addrType: addressTypeIPv6,
+		},
+		"FQDN_address": {
+			hostport: "localhost:80",
+			addrType: addressTypeFQDN,
+		},
+		"missing_port": {
+			hostport:  "localhost",
+			errString: "address localhost: missing port in address",
+		},
+		"invalid_port": {
+			hostport:  "localhost:70000",
+			errString: "strconv.ParseUint: parsing \"70000\": value out of range",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			addr, err := parseAddress(tc.hostport)
+			if tc.errString != "" {
+				require.EqualError(t, err, tc.errString)
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.addrType, addr.Type)
+			assert.Equal(t, tc.hostport, addr.String())
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package socks5
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errReloadNotConfigured = errors.New("reloader is not configured")
+
+// AdminHandler returns the handler of the admin HTTP API:
+//
+//	GET    /sessions                 list the active sessions
+//	DELETE /sessions/{id}            close a session
+//	DELETE /users/{user}/sessions    close the sessions of a user
+//	DELETE /clients/{ip}/sessions    close the sessions of a client IP
+//	GET    /config                   view the effective config and rule counts
+//	POST   /reload                   reload the credentials and rules
+//
+// Every request must carry the bearer token set by WithAdminToken or a
+// verified client certificate, otherwise it is rejected.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /sessions", s.adminListSessions)
+	mux.HandleFunc("DELETE /sessions/{id}", s.adminCloseSession)
+	mux.HandleFunc("DELETE /users/{user}/sessions", s.adminCloseUserSessions)
+	mux.HandleFunc("DELETE /clients/{ip}/sessions", s.adminCloseClientSessions)
+	mux.HandleFunc("GET /config", s.adminConfig)
+	mux.HandleFunc("POST /reload", s.adminReload)
+
+	return s.adminAuthorize(mux)
+}
+
+// Reload replaces the credentials store and the rules with the ones
+// returned by the Reloader, active sessions are not affected.
+func (s *Server) Reload(ctx context.Context) error {
+	if s.reloader == nil {
+		return errReloadNotConfigured
+	}
+
+	store, rules, err := s.reloader(ctx)
+	if err != nil {
+		return err
+	}
+
+	current := s.policy.Load()
+
+	next := &policy{
+		store: current.store,
+		rules: current.rules,
+	}
+
+	if store != nil {
+		next.store = store
+	}
+
+	if rules != nil {
+		next.rules = rules
+	}
+
+	s.policy.Store(next)
+
+	s.logger.Info(ctx, "credentials and rules reloaded")
+
+	return nil
+}
+
+func (s *Server) listenAndServeAdmin(ctx context.Context) error {
+	l, err := s.driver.Listen("tcp", s.config.adminAddress)
+	if err != nil {
+		return err
+	}
+
+	if s.config.adminTLSConfig != nil {
+		l = tls.NewListener(l, s.config.adminTLSConfig)
+	}
+
+	s.adminServer = &http.Server{
+		Handler:           s.AdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := s.adminServer.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error(ctx, "failed to serve admin api", LogKeyError, err)
+		}
+	}()
+
+	s.logger.Info(ctx, "admin api starting...", "address", l.Addr().String())
+
+	return nil
+}
+
+func (s *Server) adminAuthorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) isAdminAuthorized(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+
+	if s.config.adminToken == "" {
+		return false
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.adminToken)) == 1
+}
+
+func (s *Server) adminListSessions(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.Sessions())
+}
+
+func (s *Server) adminCloseSession(w http.ResponseWriter, r *http.Request) {
+	if err := s.CloseSession(r.PathValue("id")); err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, closedSessions{Closed: 1})
+}
+
+func (s *Server) adminCloseUserSessions(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("user")
+
+	closed := s.closeSessions(func(info SessionInfo) bool {
+		return info.Username == user
+	})
+
+	writeJSON(w, http.StatusOK, closedSessions{Closed: closed})
+}
+
+func (s *Server) adminCloseClientSessions(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid client ip")
+		return
+	}
+
+	closed := s.closeSessions(func(info SessionInfo) bool {
+		host, _, err := net.SplitHostPort(info.ClientAddress)
+		return err == nil && ip.Equal(net.ParseIP(host))
+	})
+
+	writeJSON(w, http.StatusOK, closedSessions{Closed: closed})
+}
+
+func (s *Server) adminConfig(w http.ResponseWriter, _ *http.Request) {
+	methods := make([]string, 0, len(s.config.authMethods))
+	for method := range s.config.authMethods {
+		methods = append(methods, authMethodName(method))
+	}
+
+	sort.Strings(methods)
+
+	var ruleCounts map[string]int
+	if counter, ok := s.policy.Load().rules.(RuleCounter); ok {
+		ruleCounts = counter.RuleCounts()
+	}
+
+	writeJSON(w, http.StatusOK, adminConfig{
+		Address:            s.config.address,
+		PublicIP:           s.config.publicIP.String(),
+		AuthMethods:        methods,
+		ReadTimeout:        s.config.readTimeout.String(),
+		WriteTimeout:       s.config.writeTimeout.String(),
+		GetPasswordTimeout: s.config.getPasswordTimeout.String(),
+		PacketWriteTimeout: s.config.packetWriteTimeout.String(),
+		TTLPacket:          s.config.ttlPacket.String(),
+		NatCleanupPeriod:   s.config.natCleanupPeriod.String(),
+		NatMaxEntries:      s.nat.maxEntries,
+		NatMaxGlobal:       s.nat.maxGlobal,
+		UDPFiltering:       s.config.udpFiltering.String(),
+		UDPFragmentMTU:     s.config.udpMTU,
+		UDPRelayPorts:      s.config.udpRelayPorts,
+		UDPPacketRate:      s.config.udpPacketRate,
+		UDPByteRate:        s.config.udpByteRate,
+		DNSInterception:    s.config.dnsInterception,
+		SniffTimeout:       s.config.sniffTimeout.String(),
+		ActiveSessions:     len(s.sessions.list()),
+		RuleCounts:         ruleCounts,
+	})
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, r *http.Request) {
+	if err := s.Reload(r.Context()); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errReloadNotConfigured) {
+			status = http.StatusNotImplemented
+		}
+
+		writeJSONError(w, status, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+// closeSessions terminates the active sessions that match and returns their number.
+func (s *Server) closeSessions(match func(info SessionInfo) bool) int {
+	var closed int
+
+	for _, sess := range s.sessions.list() {
+		if match(sess.info()) {
+			sess.terminate()
+			closed++
+		}
+	}
+
+	return closed
+}
+
+type closedSessions struct {
+	Closed int `json:"closed"`
+}
+
+type adminConfig struct {
+	Address            string         `json:"address"`
+	PublicIP           string         `json:"public_ip"`
+	AuthMethods        []string       `json:"auth_methods"`
+	ReadTimeout        string         `json:"read_timeout"`
+	WriteTimeout       string         `json:"write_timeout"`
+	GetPasswordTimeout string         `json:"get_password_timeout"`
+	PacketWriteTimeout string         `json:"packet_write_timeout"`
+	TTLPacket          string         `json:"ttl_packet"`
+	NatCleanupPeriod   string         `json:"nat_cleanup_period"`
+	NatMaxEntries      int            `json:"nat_max_entries"`
+	NatMaxGlobal       int            `json:"nat_max_global_entries"`
+	UDPFiltering       string         `json:"udp_filtering"`
+	UDPFragmentMTU     int            `json:"udp_fragment_mtu,omitempty"`
+	UDPRelayPorts      []int          `json:"udp_relay_ports,omitempty"`
+	UDPPacketRate      int            `json:"udp_packet_rate,omitempty"`
+	UDPByteRate        int            `json:"udp_byte_rate,omitempty"`
+	DNSInterception    bool           `json:"dns_interception,omitempty"`
+	SniffTimeout       string         `json:"sniff_timeout"`
+	ActiveSessions     int            `json:"active_sessions"`
+	RuleCounts         map[string]int `json:"rule_counts,omitempty"`
+}
+
+func authMethodName(method byte) string {
+	switch method {
+	case noAuthenticationRequired:
+		return "no_authentication"
+	case usernamePasswordAuthentication:
+		return "username_password"
+	default:
+		return "unknown"
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCloser struct {
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestAdminHandler(t *testing.T) {
+	srv := New(
+		WithLogger(NopLogger),
+		WithAdminToken("secret"),
+		WithBlockListHosts("example.com"),
+		WithReloader(func(_ context.Context) (Store, Rules, error) {
+			return nil, &serverRules{allowCommands: permitAllCommands()}, nil
+		}),
+	)
+
+	closers := map[string]*testCloser{}
+
+	for _, client := range []string{"10.0.0.1:4000", "10.0.0.1:4001", "10.0.0.2:4000"} {
+		addr, err := net.ResolveTCPAddr("tcp", client)
+		require.NoError(t, err)
+
+		sess := newSession(addr)
+		sess.setUsername("user-" + client[len(client)-1:])
+		sess.setRequest(connect, "example.org:80")
+
+		closers[client] = &testCloser{}
+		sess.onTerminate(closers[client])
+
+		srv.sessions.add(sess)
+	}
+
+	handler := srv.AdminHandler()
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/sessions", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/sessions", "wrong").Code)
+
+	response := do("GET", "/sessions", "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	var sessions []map[string]any
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 3)
+	assert.Equal(t, "connect", sessions[0]["command"])
+
+	response = do("DELETE", "/clients/10.0.0.1/sessions", "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"closed":2}`, response.Body.String())
+	assert.True(t, closers["10.0.0.1:4000"].closed)
+	assert.True(t, closers["10.0.0.1:4001"].closed)
+	assert.False(t, closers["10.0.0.2:4000"].closed)
+
+	response = do("DELETE", "/users/user-0/sessions", "secret")
+	assert.JSONEq(t, `{"closed":2}`, response.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/sessions/unknown", "secret").Code)
+
+	for _, info := range srv.Sessions() {
+		if info.ClientAddress == "10.0.0.2:4000" {
+			assert.Equal(t, http.StatusOK, do("DELETE", "/sessions/"+info.ID, "secret").Code)
+		}
+	}
+
+	response = do("GET", "/config", "secret")
+	require.Equal(t, http.StatusOK, response.Code)
+
+	var config adminConfig
+	require.NoError(t, json.Unmarshal(response.Body.Bytes(), &config))
+	assert.Equal(t, ":1080", config.Address)
+	assert.Equal(t, []string{"no_authentication"}, config.AuthMethods)
+	assert.Equal(t, 1, config.RuleCounts["block_list_hosts"])
+
+	require.Equal(t, http.StatusOK, do("POST", "/reload", "secret").Code)
+	assert.True(t, srv.policy.Load().rules.IsAllowDestination(context.Background(), "example.com"))
+}
+
+func TestAdminListener(t *testing.T) {
+	srv := New(
+		WithLogger(NopLogger),
+		WithPort(1164),
+		WithAdminAddress("127.0.0.1:1165"),
+		WithAdminToken("secret"),
+	)
+
+	go srv.ListenAndServe()
+
+	t.Cleanup(func() {
+		srv.Shutdown()
+	})
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	request, err := http.NewRequest("POST", "http://127.0.0.1:1165/reload", nil)
+	require.NoError(t, err)
+
+	request.Header.Set("Authorization", "Bearer secret")
+
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	assert.Equal(t, http.StatusNotImplemented, response.StatusCode)
+}
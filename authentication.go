@@ -15,7 +15,7 @@ func (s *Server) choiceAuthenticationMethod(methods []byte) byte {
 func (s *Server) usernamePasswordAuthenticate(ctx context.Context, conn *connection) {
 	version, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read authentication version: "+err.Error())
+		s.logger.Error(ctx, "failed to read authentication version", LogKeyError, err)
 		return
 	}
 
@@ -25,13 +25,13 @@ func (s *Server) usernamePasswordAuthenticate(ctx context.Context, conn *connect
 
 	usernameLen, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read username length: "+err.Error())
+		s.logger.Error(ctx, "failed to read username length", LogKeyError, err)
 		return
 	}
 
 	username := make([]byte, usernameLen)
 	if _, err := conn.read(username); err != nil {
-		s.logger.Error(ctx, "failed to read username: "+err.Error())
+		s.logger.Error(ctx, "failed to read username", LogKeyError, err)
 		return
 	}
 
@@ -39,33 +39,58 @@ func (s *Server) usernamePasswordAuthenticate(ctx context.Context, conn *connect
 
 	passwordLen, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read password length: "+err.Error())
+		s.logger.Error(ctx, "failed to read password length", LogKeyError, err)
 		return
 	}
 
 	password := make([]byte, passwordLen)
 	if _, err := conn.read(password); err != nil {
-		s.logger.Error(ctx, "failed to read password: "+err.Error())
+		s.logger.Error(ctx, "failed to read password", LogKeyError, err)
 		return
 	}
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, s.config.getPasswordTimeout)
-	defer cancel()
-
-	passwordFromStore, err := s.store.GetPassword(ctxTimeout, string(username))
+	// A store error, such as an unknown user, fails the authentication.
+	passwordFromStore, err := s.getPassword(ctx, string(username))
 	if err != nil {
-		s.logger.Error(ctx, "failed to get user password from store: "+err.Error())
-		return
+		s.logger.Error(ctx, "failed to get user password from store", LogKeyError, err)
 	}
 
-	if string(password) != passwordFromStore {
-		s.logger.Warn(ctx, "failed to authenticate user ["+string(username)+"]")
+	if err != nil || string(password) != passwordFromStore {
+		s.hooks.onAuth(ctx, string(username), usernamePasswordAuthentication, false)
+
+		s.metrics.AuthenticationFailure(ctx)
+
+		sess := sessionFromContext(ctx)
+		sess.setUsername(string(username))
+		sess.close(CloseReasonDenied)
+
+		s.logger.Warn(ctx, "failed to authenticate user")
 
 		s.response(ctx, conn, usernamePasswordVersion, usernamePasswordFailure)
 		return
 	}
 
+	s.hooks.onAuth(ctx, string(username), usernamePasswordAuthentication, true)
+
+	sessionFromContext(ctx).setUsername(string(username))
+	sessionSpanFromContext(ctx).SetAttributes(Attribute{Key: AttributeUser, Value: string(username)})
+
 	s.response(ctx, conn, usernamePasswordVersion, usernamePasswordSuccess)
 
 	s.acceptRequest(ctx, conn)
 }
+
+func (s *Server) getPassword(ctx context.Context, username string) (string, error) {
+	ctx, span := s.tracer.Start(ctx, SpanAuthenticate)
+	defer span.End()
+
+	span.SetAttributes(Attribute{Key: AttributeUser, Value: username})
+
+	ctx, cancel := context.WithTimeout(ctx, s.config.getPasswordTimeout)
+	defer cancel()
+
+	password, err := s.policy.Load().store.GetPassword(ctx, username)
+	span.RecordError(err)
+
+	return password, err
+}
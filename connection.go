@@ -2,15 +2,18 @@ package socks5
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"net"
+	"time"
 )
 
 type connection struct {
 	net.Conn
-	reader  *bufio.Reader
-	done    chan struct{}
-	closeFn func()
+	reader       *bufio.Reader
+	readDeadline time.Time
+	done         chan struct{}
+	closeFn      func()
 }
 
 func newConnection(conn net.Conn) *connection {
@@ -21,6 +24,32 @@ func newConnection(conn net.Conn) *connection {
 	}
 }
 
+func (c *connection) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// cancelOnClose calls cancel when the client closes the connection until stop
+// is called. The bytes sent by the client in the meantime stay in the reader.
+func (c *connection) cancelOnClose(cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if _, err := c.reader.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+
+	return func() {
+		// Unblock the peek and restore the deadline.
+		c.Conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.Conn.SetReadDeadline(c.readDeadline)
+	}
+}
+
 func (c *connection) readByte() (byte, error) {
 	return c.reader.ReadByte()
 }
@@ -33,6 +62,38 @@ func (c *connection) write(p []byte) (int, error) {
 	return c.Conn.Write(p)
 }
 
+// flushBuffered writes the bytes buffered by the reader to w.
+func (c *connection) flushBuffered(w io.Writer) (int64, error) {
+	buffered, err := c.reader.Peek(c.reader.Buffered())
+	if err != nil || len(buffered) == 0 {
+		return 0, err
+	}
+
+	n, err := w.Write(buffered)
+	c.reader.Discard(n)
+
+	return int64(n), err
+}
+
+// peek waits up to the timeout for the bytes of the stream and passes the
+// buffered bytes to parse until it is done or the buffer is full. The bytes
+// stay in the reader to be relayed.
+func (c *connection) peek(timeout time.Duration, parse func(buffered []byte) (done bool)) {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.Conn.SetReadDeadline(c.readDeadline)
+
+	for n := 1; n <= c.reader.Size(); n = c.reader.Buffered() + 1 {
+		if _, err := c.reader.Peek(n); err != nil {
+			return
+		}
+
+		buffered, _ := c.reader.Peek(c.reader.Buffered())
+		if parse(buffered) {
+			return
+		}
+	}
+}
+
 func (c *connection) isActive() bool {
 	select {
 	case <-c.done:
@@ -63,6 +124,11 @@ func (c *connection) onClose(f func()) {
 func (c *connection) keepAlive() {
 	io.Copy(io.Discard, c)
 
+	c.finish()
+}
+
+// finish marks the connection as closed by the client and calls the close function.
+func (c *connection) finish() {
 	if !c.isActive() {
 		return
 	}
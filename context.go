@@ -10,6 +10,13 @@ type ctxKey int
 const (
 	remoteAddressKey ctxKey = iota
 	usernameKey
+	commandKey
+	destinationKey
+	spanKey
+	sessionSpanKey
+	sessionKey
+	sessionIDKey
+	sniffedHostKey
 )
 
 func contextWithRemoteAddress(ctx context.Context, addr net.Addr) context.Context {
@@ -29,3 +36,44 @@ func UsernameFromContext(ctx context.Context) (string, bool) {
 	value, ok := ctx.Value(usernameKey).(string)
 	return value, ok
 }
+
+func contextWithCommand(ctx context.Context, cmd byte) context.Context {
+	return context.WithValue(ctx, commandKey, Command(cmd))
+}
+
+func CommandFromContext(ctx context.Context) (Command, bool) {
+	value, ok := ctx.Value(commandKey).(Command)
+	return value, ok
+}
+
+func contextWithDestination(ctx context.Context, destination string) context.Context {
+	return context.WithValue(ctx, destinationKey, destination)
+}
+
+// DestinationFromContext returns the destination requested by the client.
+func DestinationFromContext(ctx context.Context) (string, bool) {
+	value, ok := ctx.Value(destinationKey).(string)
+	return value, ok
+}
+
+func contextWithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey, id)
+}
+
+// SessionIDFromContext returns the unique identifier of the session
+// that the accepted connection belongs to.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	value, ok := ctx.Value(sessionIDKey).(string)
+	return value, ok
+}
+
+func contextWithSniffedHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, sniffedHostKey, host)
+}
+
+// SniffedHostFromContext returns the host name sniffed from the stream of a
+// CONNECT request to an IP destination, a Driver can route the dial by it.
+func SniffedHostFromContext(ctx context.Context) (string, bool) {
+	value, ok := ctx.Value(sniffedHostKey).(string)
+	return value, ok
+}
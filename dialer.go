@@ -0,0 +1,214 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultDialAttemptDelay is the Connection Attempt Delay recommended by RFC 8305 section 5.
+const defaultDialAttemptDelay = 250 * time.Millisecond
+
+// ContextDialer is an optional interface of Driver. The server dials with it
+// when the Driver implements it, so that a dial is canceled when the client
+// disconnects or the session is closed.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialAttempt is a connection attempt to one of the resolved addresses of a destination.
+type DialAttempt struct {
+	Address  string
+	Duration time.Duration
+	// Err is nil for the attempt that succeeded.
+	Err error
+}
+
+// DialError is returned by the default Driver when every connection attempt failed.
+type DialError struct {
+	Address  string
+	Attempts []DialAttempt
+}
+
+func (e *DialError) Error() string {
+	failures := make([]string, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		failures = append(failures, attempt.Address+": "+attempt.Err.Error())
+	}
+
+	return "dial " + e.Address + ": " + strings.Join(failures, "; ")
+}
+
+func (e *DialError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Attempts))
+	for _, attempt := range e.Attempts {
+		errs = append(errs, attempt.Err)
+	}
+
+	return errs
+}
+
+// replyCode returns the most specific reply code of the attempts: a refused
+// connection means that the host was reached, so it beats an unreachable one.
+func (e *DialError) replyCode() ReplyCode {
+	priority := map[ReplyCode]int{
+		ReplyConnectionRefused:  3,
+		ReplyHostUnreachable:    2,
+		ReplyNetworkUnreachable: 1,
+	}
+
+	code := ReplyGeneralFailure
+
+	for _, attempt := range e.Attempts {
+		if c := replyCodeFromError(attempt.Err); priority[c] > priority[code] {
+			code = c
+		}
+	}
+
+	return code
+}
+
+type dialReporterKey struct{}
+
+// ContextWithDialReporter returns a context whose dials by the default Driver
+// report every finished connection attempt to fn.
+func ContextWithDialReporter(ctx context.Context, fn func(attempt DialAttempt)) context.Context {
+	return context.WithValue(ctx, dialReporterKey{}, fn)
+}
+
+// DialReporterFromContext returns the function set by ContextWithDialReporter,
+// a custom Driver can call it to report its attempts.
+func DialReporterFromContext(ctx context.Context) func(attempt DialAttempt) {
+	if fn, ok := ctx.Value(dialReporterKey{}).(func(attempt DialAttempt)); ok {
+		return fn
+	}
+
+	return func(DialAttempt) {}
+}
+
+type dialResult struct {
+	conn    net.Conn
+	attempt DialAttempt
+}
+
+// dialHappyEyeballs races connection attempts to the addresses in order, RFC 8305:
+// an attempt starts when the previous one fails or after the attempt delay,
+// the first established connection wins and the other attempts are canceled.
+func dialHappyEyeballs(ctx context.Context, dialer ContextDialer, network, address string, addresses []string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := DialReporterFromContext(ctx)
+
+	results := make(chan dialResult, len(addresses))
+
+	var (
+		next     int
+		pending  int
+		attempts []DialAttempt
+	)
+
+	startAttempt := func() {
+		target := addresses[next]
+		next++
+		pending++
+
+		go func() {
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, target)
+
+			results <- dialResult{
+				conn: conn,
+				attempt: DialAttempt{
+					Address:  target,
+					Duration: time.Since(start),
+					Err:      err,
+				},
+			}
+		}()
+	}
+
+	startAttempt()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case result := <-results:
+			pending--
+
+			report(result.attempt)
+
+			if result.attempt.Err == nil {
+				go closeLateConns(results, pending)
+
+				return result.conn, nil
+			}
+
+			attempts = append(attempts, result.attempt)
+
+			if next < len(addresses) {
+				startAttempt()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if next < len(addresses) {
+				startAttempt()
+				timer.Reset(delay)
+			}
+		}
+	}
+
+	return nil, &DialError{Address: address, Attempts: attempts}
+}
+
+// closeLateConns closes the connections of the attempts that lost the race.
+func closeLateConns(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
+
+// interleaveFamilies orders the addresses by alternating the address families,
+// starting with IPv6 unless IPv4 is preferred, RFC 8305 section 4.
+func interleaveFamilies(ips []net.IP, preference IPPreference) []net.IP {
+	var ipv4, ipv6 []net.IP
+
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, ip)
+		} else {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+
+	switch preference {
+	case OnlyIPv4:
+		return ipv4
+	case OnlyIPv6:
+		return ipv6
+	}
+
+	first, second := ipv6, ipv4
+	if preference == PreferIPv4 {
+		first, second = ipv4, ipv6
+	}
+
+	result := make([]net.IP, 0, len(ips))
+
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			result = append(result, first[i])
+		}
+
+		if i < len(second) {
+			result = append(result, second[i])
+		}
+	}
+
+	return result
+}
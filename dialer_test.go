@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func closedPort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	address := l.Addr().String()
+	l.Close()
+
+	return address
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	refused := closedPort(t)
+
+	var attempts []DialAttempt
+
+	ctx := ContextWithDialReporter(context.Background(), func(attempt DialAttempt) {
+		attempts = append(attempts, attempt)
+	})
+
+	conn, err := dialHappyEyeballs(ctx, &net.Dialer{}, "tcp", "example.test:80",
+		[]string{refused, l.Addr().String()}, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+
+	// The failed attempt starts the next one without waiting for the delay.
+	require.Len(t, attempts, 2)
+	assert.Equal(t, refused, attempts[0].Address)
+	assert.True(t, isConnectionRefusedError(attempts[0].Err))
+	assert.Equal(t, l.Addr().String(), attempts[1].Address)
+	assert.NoError(t, attempts[1].Err)
+}
+
+func TestDialHappyEyeballsRace(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	slow := &net.Dialer{
+		// Delay the first attempt past the attempt delay.
+		Control: func(_, address string, _ syscall.RawConn) error {
+			if address != l.Addr().String() {
+				time.Sleep(200 * time.Millisecond)
+			}
+
+			return nil
+		},
+	}
+
+	start := time.Now()
+
+	conn, err := dialHappyEyeballs(context.Background(), slow, "tcp", "example.test:80",
+		[]string{closedPort(t), l.Addr().String()}, 20*time.Millisecond)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestDialHappyEyeballsFailure(t *testing.T) {
+	addresses := []string{closedPort(t), closedPort(t)}
+
+	_, err := dialHappyEyeballs(context.Background(), &net.Dialer{}, "tcp", "example.test:80", addresses, time.Second)
+
+	var dialErr *DialError
+	require.True(t, errors.As(err, &dialErr))
+	assert.Equal(t, "example.test:80", dialErr.Address)
+	require.Len(t, dialErr.Attempts, 2)
+	assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Equal(t, ReplyConnectionRefused, replyCodeFromError(err))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = dialHappyEyeballs(ctx, &net.Dialer{}, "tcp", "example.test:80", addresses, time.Second)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDialErrorReplyCode(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+	refused := &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	timeout := errors.New("i/o timeout")
+
+	cases := map[string]struct {
+		errs []error
+		want ReplyCode
+	}{
+		"refused_beats_unreachable": {
+			errs: []error{unreachable, refused},
+			want: ReplyConnectionRefused,
+		},
+		"unreachable_beats_general": {
+			errs: []error{timeout, unreachable},
+			want: ReplyNetworkUnreachable,
+		},
+		"general": {
+			errs: []error{timeout},
+			want: ReplyGeneralFailure,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dialErr := &DialError{Address: "example.test:80"}
+			for _, err := range tc.errs {
+				dialErr.Attempts = append(dialErr.Attempts, DialAttempt{Address: "192.0.2.1:80", Err: err})
+			}
+
+			assert.Equal(t, tc.want, replyCodeFromError(dialErr))
+		})
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("192.0.2.3"),
+	}
+
+	cases := map[string]struct {
+		preference IPPreference
+		want       []string
+	}{
+		"ipv6_first_by_default": {
+			preference: PreferNone,
+			want:       []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		},
+		"prefer_ipv4": {
+			preference: PreferIPv4,
+			want:       []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"},
+		},
+		"only_ipv4": {
+			preference: OnlyIPv4,
+			want:       []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		},
+		"only_ipv6": {
+			preference: OnlyIPv6,
+			want:       []string{"2001:db8::1", "2001:db8::2"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := make([]string, 0, len(tc.want))
+			for _, ip := range interleaveFamilies(ips, tc.preference) {
+				got = append(got, ip.String())
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNetDriverDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	d := &netDriver{
+		attemptDelay: defaultDialAttemptDelay,
+		preference:   OnlyIPv4,
+		resolver:     &systemResolver{},
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	d.preference = OnlyIPv6
+
+	_, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	assert.True(t, isNoSuchHostError(err))
+}
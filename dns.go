@@ -0,0 +1,350 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsPort          = "53"
+	dnsOverTLSPort   = "853"
+	udpDNSBufferSize = 4096
+)
+
+var (
+	errDNSIDMismatch    = errors.New("dns response id does not match the query")
+	errDNSServerFailure = errors.New("dns server failure")
+)
+
+// dnsTransport sends a packed DNS query to an upstream server and returns the packed response.
+type dnsTransport interface {
+	exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// parseUpstream returns the transport of an upstream server given as
+// "udp://host:port", "tcp://host:port", "tls://host:port", an https URL
+// of a DoH endpoint or "host[:port]" for UDP.
+func parseUpstream(server string, tlsConfig *tls.Config, bootstrap []net.IP) (dnsTransport, error) {
+	scheme, address, ok := strings.Cut(server, "://")
+	if !ok {
+		scheme, address = "udp", server
+	}
+
+	if scheme == "https" {
+		return newHTTPSDNSTransport(server, tlsConfig, bootstrap)
+	}
+
+	port := dnsPort
+	if scheme == "tls" {
+		port = dnsOverTLSPort
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+
+	switch scheme {
+	case "udp":
+		return &udpDNSTransport{address: address}, nil
+	case "tcp":
+		return &tcpDNSTransport{address: address}, nil
+	case "tls":
+		return newTLSDNSTransport(address, tlsConfig, bootstrap), nil
+	default:
+		return nil, fmt.Errorf("unsupported dns upstream scheme %q", scheme)
+	}
+}
+
+// upstreamName returns the host name of a DNS-over-TLS or DNS-over-HTTPS
+// upstream server, or an empty string when it is given by IP or not encrypted.
+func upstreamName(server string) string {
+	scheme, address, _ := strings.Cut(server, "://")
+
+	switch scheme {
+	case "https":
+		address, _, _ = strings.Cut(address, "/")
+	case "tls":
+	default:
+		return ""
+	}
+
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+
+	return host
+}
+
+type udpDNSTransport struct {
+	address string
+}
+
+// exchange retries the query over TCP when the UDP response is truncated.
+func (t *udpDNSTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "udp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	setContextDeadline(ctx, conn)
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, udpDNSBufferSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Drop a stray datagram that answers another query.
+		if n < 12 || binary.BigEndian.Uint16(buf) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+
+		var parser dnsmessage.Parser
+
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Truncated {
+			return (&tcpDNSTransport{address: t.address}).exchange(ctx, query)
+		}
+
+		return buf[:n], nil
+	}
+}
+
+type tcpDNSTransport struct {
+	address string
+}
+
+func (t *tcpDNSTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	setContextDeadline(ctx, conn)
+
+	return exchangeStream(conn, query)
+}
+
+// exchangeStream writes the query with a two byte length prefix, RFC 1035 section 4.2.2,
+// and reads the response framed the same way.
+func exchangeStream(rw io.ReadWriter, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+
+	if _, err := rw.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(rw, length[:]); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(rw, response); err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func setContextDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+}
+
+func newDNSQuery(name string, qtype dnsmessage.Type) ([]byte, uint16, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var id [2]byte
+	rand.Read(id[:])
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return query, msg.Header.ID, nil
+}
+
+// parseDNSAnswer returns the addresses of the answer with the lowest TTL of the records.
+// A missing name or a missing record type is a not found error cached for the SOA
+// minimum TTL, RFC 2308, or negativeTTL without an SOA record.
+func parseDNSAnswer(response []byte, id uint16, name string, qtype dnsmessage.Type, negativeTTL time.Duration) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return nil, 0, err
+	}
+
+	if msg.Header.ID != id {
+		return nil, 0, errDNSIDMismatch
+	}
+
+	notFound := &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, soaTTL(msg.Authorities, negativeTTL), notFound
+	default:
+		return nil, 0, fmt.Errorf("%w: %s", errDNSServerFailure, msg.Header.RCode)
+	}
+
+	var (
+		ips []net.IP
+		ttl uint32
+	)
+
+	for _, answer := range msg.Answers {
+		var ip net.IP
+
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				ip = net.IP(body.A[:])
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				ip = net.IP(body.AAAA[:])
+			}
+		}
+
+		if ip == nil {
+			continue
+		}
+
+		if len(ips) == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return nil, soaTTL(msg.Authorities, negativeTTL), notFound
+	}
+
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// parsePTRAnswer returns the names of the PTR records of the answer.
+func parsePTRAnswer(response []byte, id uint16, name string) ([]string, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return nil, err
+	}
+
+	if msg.Header.ID != id {
+		return nil, errDNSIDMismatch
+	}
+
+	notFound := &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, notFound
+	default:
+		return nil, fmt.Errorf("%w: %s", errDNSServerFailure, msg.Header.RCode)
+	}
+
+	var names []string
+
+	for _, answer := range msg.Answers {
+		if ptr, ok := answer.Body.(*dnsmessage.PTRResource); ok {
+			names = append(names, ptr.PTR.String())
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, notFound
+	}
+
+	return names, nil
+}
+
+// reverseName returns the name of the PTR record of the IP address,
+// RFC 1035 section 3.5 and RFC 3596 section 2.5.
+func reverseName(ip net.IP) string {
+	var name strings.Builder
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&name, "%d.", ip4[i])
+		}
+
+		return name.String() + "in-addr.arpa"
+	}
+
+	const hexDigits = "0123456789abcdef"
+
+	ip16 := ip.To16()
+
+	for i := len(ip16) - 1; i >= 0; i-- {
+		name.WriteByte(hexDigits[ip16[i]&0x0f])
+		name.WriteByte('.')
+		name.WriteByte(hexDigits[ip16[i]>>4])
+		name.WriteByte('.')
+	}
+
+	return name.String() + "ip6.arpa"
+}
+
+func soaTTL(authorities []dnsmessage.Resource, fallback time.Duration) time.Duration {
+	for _, authority := range authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(authority.Header.TTL, soa.MinTTL)) * time.Second
+		}
+	}
+
+	return fallback
+}
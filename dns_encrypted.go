@@ -0,0 +1,211 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsMessageContentType = "application/dns-message"
+	maxDNSMessageSize     = 65535
+	maxIdleDNSConns       = 4
+	idleDNSConnTimeout    = 90 * time.Second
+)
+
+var errDNSOverHTTPSStatus = errors.New("unexpected dns-over-https response status")
+
+// tlsDNSTransport sends queries over TLS, RFC 7858, and keeps the connections
+// open for the next queries.
+type tlsDNSTransport struct {
+	address   string
+	config    *tls.Config
+	bootstrap []net.IP
+	mutex     sync.Mutex
+	idle      []net.Conn
+}
+
+func newTLSDNSTransport(address string, config *tls.Config, bootstrap []net.IP) *tlsDNSTransport {
+	return &tlsDNSTransport{
+		address:   address,
+		config:    upstreamTLSConfig(config, address),
+		bootstrap: bootstrap,
+	}
+}
+
+// exchange retries the query once on a new connection when a reused one fails,
+// the server may have closed it in the meantime.
+func (t *tlsDNSTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, reused := t.get()
+
+	for {
+		if conn == nil {
+			rawConn, err := dialUpstream(ctx, "tcp", t.address, t.bootstrap)
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConn := tls.Client(rawConn, t.config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				rawConn.Close()
+				return nil, err
+			}
+
+			conn = tlsConn
+		}
+
+		setContextDeadline(ctx, conn)
+
+		response, err := exchangeStream(conn, query)
+		if err != nil {
+			conn.Close()
+
+			if reused && ctx.Err() == nil {
+				conn, reused = nil, false
+				continue
+			}
+
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+		t.put(conn)
+
+		return response, nil
+	}
+}
+
+func (t *tlsDNSTransport) get() (net.Conn, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.idle) == 0 {
+		return nil, false
+	}
+
+	conn := t.idle[len(t.idle)-1]
+	t.idle = t.idle[:len(t.idle)-1]
+
+	return conn, true
+}
+
+func (t *tlsDNSTransport) put(conn net.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.idle) >= maxIdleDNSConns {
+		conn.Close()
+		return
+	}
+
+	t.idle = append(t.idle, conn)
+}
+
+// httpsDNSTransport posts queries to a DNS-over-HTTPS endpoint, RFC 8484,
+// the HTTP client keeps the connections alive and uses HTTP/2 when it can.
+type httpsDNSTransport struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSDNSTransport(endpoint string, config *tls.Config, bootstrap []net.IP) (*httpsDNSTransport, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialUpstream(ctx, network, address, bootstrap)
+		},
+		TLSClientConfig:     upstreamTLSConfig(config, u.Host),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleDNSConns,
+		IdleConnTimeout:     idleDNSConnTimeout,
+	}
+
+	return &httpsDNSTransport{
+		url:    endpoint,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (t *httpsDNSTransport) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("%w: %s", errDNSOverHTTPSStatus, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+// dialUpstream dials the address, or the bootstrap IPs in order
+// in place of the host when it is a name.
+func dialUpstream(ctx context.Context, network, address string, bootstrap []net.IP) (net.Conn, error) {
+	var dialer net.Dialer
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bootstrap) == 0 || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	var lastErr error
+
+	for _, ip := range bootstrap {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// upstreamTLSConfig returns a copy of the config that verifies the certificate against the host.
+func upstreamTLSConfig(config *tls.Config, address string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+
+	config = config.Clone()
+
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = strings.Trim(address, "[]")
+		}
+
+		config.ServerName = host
+	}
+
+	return config
+}
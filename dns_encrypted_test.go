@@ -0,0 +1,263 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDNSOverHTTPSServer returns a DoH stand-in answering with the stub and the number of its connections.
+func newDNSOverHTTPSServer(t *testing.T, stub *dnsStub) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var conns atomic.Int64
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dnsMessageContentType {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		query, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response, err := stub.answer(query, false)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(response)
+	}))
+
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+
+	t.Cleanup(srv.Close)
+
+	return srv, &conns
+}
+
+func serverRootCAs(srv *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	return pool
+}
+
+func TestUpstreamName(t *testing.T) {
+	testCases := map[string]string{
+		"https://dns.google/dns-query":      "dns.google",
+		"https://dns.google:8443/dns-query": "dns.google",
+		"https://1.1.1.1/dns-query":         "",
+		"tls://one.one.one.one":             "one.one.one.one",
+		"tls://one.one.one.one:853":         "one.one.one.one",
+		"tls://[2606:4700::1111]:853":       "",
+		"udp://dns.example:53":              "",
+		"dns.example":                       "",
+	}
+
+	for server, name := range testCases {
+		assert.Equal(t, name, upstreamName(server), server)
+	}
+}
+
+func TestCachingResolverBootstrapIPs(t *testing.T) {
+	// One list of bootstrap IPs cannot serve two names.
+	_, err := NewCachingResolver(
+		WithResolverUpstreams("https://dns.google/dns-query", "tls://one.one.one.one"),
+		WithResolverBootstrapIPs(net.ParseIP("8.8.8.8")),
+	)
+	assert.ErrorIs(t, err, errSharedBootstrapIPs)
+
+	_, err = NewCachingResolver(
+		WithResolverUpstream("https://dns.google/dns-query", net.ParseIP("8.8.8.8")),
+		WithResolverUpstream("tls://one.one.one.one", net.ParseIP("1.1.1.1")),
+		WithResolverUpstreams("https://9.9.9.9/dns-query"),
+		WithResolverBootstrapIPs(net.ParseIP("8.8.8.8")),
+	)
+	assert.NoError(t, err)
+}
+
+func TestCachingResolverDNSOverHTTPS(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+	srv, conns := newDNSOverHTTPSServer(t, stub)
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "https://"))
+
+	// The certificate of the stand-in is valid for example.com.
+	named := "https://example.com:" + port + "/dns-query"
+
+	cases := map[string]struct {
+		opts []ResolverOption
+	}{
+		"ip_endpoint": {
+			opts: []ResolverOption{WithResolverUpstreams(srv.URL + "/dns-query")},
+		},
+		"bootstrap_ips": {
+			opts: []ResolverOption{
+				WithResolverUpstreams(named),
+				WithResolverBootstrapIPs(net.ParseIP("127.0.0.1")),
+			},
+		},
+		"upstream_bootstrap_ips": {
+			opts: []ResolverOption{WithResolverUpstream(named, net.ParseIP("127.0.0.1"))},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			conns.Store(0)
+
+			r, err := NewCachingResolver(append(tc.opts,
+				WithResolverTLSConfig(&tls.Config{RootCAs: serverRootCAs(srv)}),
+			)...)
+			require.NoError(t, err)
+
+			ips, err := r.LookupIP(context.Background(), "ip4", "dual.test")
+			require.NoError(t, err)
+			assert.Equal(t, "192.0.2.1", ips[0].String())
+
+			ips, err = r.LookupIP(context.Background(), "ip6", "dual.test")
+			require.NoError(t, err)
+			assert.Equal(t, "2001:db8::1", ips[0].String())
+
+			_, err = r.LookupIP(context.Background(), "ip4", "missing.test")
+			assert.True(t, isNotFoundError(err))
+
+			assert.Equal(t, int64(1), conns.Load(), "connection is reused")
+		})
+	}
+}
+
+func TestCachingResolverDNSOverHTTPSFailure(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	r, err := NewCachingResolver(
+		WithResolverUpstreams(srv.URL+"/dns-query"),
+		WithResolverTLSConfig(&tls.Config{RootCAs: serverRootCAs(srv)}),
+	)
+	require.NoError(t, err)
+
+	_, err = r.LookupIP(context.Background(), "ip4", "dual.test")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+
+	// The certificate is not trusted without the TLS config.
+	r, err = NewCachingResolver(WithResolverUpstreams(srv.URL + "/dns-query"))
+	require.NoError(t, err)
+
+	_, err = r.LookupIP(context.Background(), "ip4", "dual.test")
+	assert.Error(t, err)
+}
+
+func TestCachingResolverDNSOverTLS(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+
+	// Borrow the certificate of an httptest server, it is valid for 127.0.0.1 and example.com.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certSrv.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: certSrv.TLS.Certificates,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+
+	go stub.serveStream(l)
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	r, err := NewCachingResolver(
+		WithResolverUpstreams("tls://example.com:"+port),
+		WithResolverBootstrapIPs(net.ParseIP("127.0.0.1")),
+		WithResolverTLSConfig(&tls.Config{RootCAs: serverRootCAs(certSrv)}),
+	)
+	require.NoError(t, err)
+
+	ips, err := r.LookupIP(context.Background(), "ip", "dual.test")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+
+	_, err = r.LookupIP(context.Background(), "ip4", "short.test")
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(3), stub.queries.Load())
+	assert.Equal(t, int64(1), stub.conns.Load(), "connection is reused")
+
+	// A broken idle connection is replaced by a new one.
+	transport := r.upstreams[0].(*tlsDNSTransport)
+	for _, conn := range transport.idle {
+		conn.Close()
+	}
+
+	_, err = r.LookupIP(context.Background(), "ip4", "missing.test")
+	assert.True(t, isNotFoundError(err))
+	assert.Equal(t, int64(2), stub.conns.Load())
+}
+
+func TestParseUpstream(t *testing.T) {
+	cases := map[string]struct {
+		server  string
+		address string
+	}{
+		"bare_ip":     {server: "192.0.2.1", address: "192.0.2.1:53"},
+		"bare_ipv6":   {server: "[2001:db8::1]", address: "[2001:db8::1]:53"},
+		"udp":         {server: "udp://192.0.2.1:5353", address: "192.0.2.1:5353"},
+		"tcp":         {server: "tcp://192.0.2.1", address: "192.0.2.1:53"},
+		"tls":         {server: "tls://dns.example", address: "dns.example:853"},
+		"https":       {server: "https://dns.example/dns-query", address: "https://dns.example/dns-query"},
+		"unsupported": {server: "quic://dns.example"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			transport, err := parseUpstream(tc.server, nil, nil)
+			if tc.address == "" {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			var address string
+
+			switch transport := transport.(type) {
+			case *udpDNSTransport:
+				address = transport.address
+			case *tcpDNSTransport:
+				address = transport.address
+			case *tlsDNSTransport:
+				address = transport.address
+				assert.Equal(t, "dns.example", transport.config.ServerName)
+			case *httpsDNSTransport:
+				address = transport.url
+			}
+
+			assert.Equal(t, tc.address, address)
+		})
+	}
+}
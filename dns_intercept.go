@@ -0,0 +1,200 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// interceptedTTL is the TTL of the answers made by the server, in seconds.
+	interceptedTTL = 60
+	// dnsMaxLocalQueries is the number of queries of an association answered
+	// with the Resolver at once, the next ones are dropped.
+	dnsMaxLocalQueries = 16
+	// dnsLocalAnswerTimeout bounds the lookup of a query answered with the Resolver.
+	dnsLocalAnswerTimeout = 5 * time.Second
+)
+
+// interceptDNS applies the destination rules to the names of a DNS query sent
+// to port 53 and answers the query when a name is blocked or when the server
+// answers the queries with its Resolver. It reports whether the query was
+// answered, a datagram that is not a DNS query is relayed. The queries answered
+// with the Resolver are answered by another goroutine, so a slow lookup does
+// not hold the other datagrams of the association.
+func (a *udpAssociation) interceptDNS(client net.Addr, p *packet) bool {
+	s := a.server
+
+	if !s.config.dnsInterception || p.address.Port.String() != dnsPort {
+		return false
+	}
+
+	var query dnsmessage.Message
+
+	if err := query.Unpack(p.payload); err != nil || query.Header.Response || len(query.Questions) == 0 {
+		return false
+	}
+
+	var answer *dnsmessage.Message
+
+	for _, question := range query.Questions {
+		if !s.policy.Load().rules.IsAllowDestination(a.ctx, dnsQuestionName(question)) {
+			s.metrics.RuleDenial(a.ctx)
+
+			answer = s.blockedDNSAnswer(&query, question)
+			break
+		}
+	}
+
+	if answer != nil {
+		return a.sendDNSAnswer(client, p.address, answer)
+	}
+
+	if !s.config.dnsLocalAnswers {
+		return false
+	}
+
+	network, ok := localDNSNetwork(&query)
+	if !ok {
+		return false
+	}
+
+	select {
+	case a.dnsQueries <- struct{}{}:
+	default:
+		a.drop(UDPDropQueueFull)
+		return true
+	}
+
+	go func() {
+		defer func() { <-a.dnsQueries }()
+
+		ctx, cancel := context.WithTimeout(a.ctx, dnsLocalAnswerTimeout)
+		defer cancel()
+
+		answer := s.localDNSAnswer(ctx, &query, network)
+
+		if a.conn.isActive() {
+			a.sendDNSAnswer(client, p.address, answer)
+		}
+	}()
+
+	return true
+}
+
+// sendDNSAnswer sends the answer to the client, it reports false
+// when the answer cannot be packed and the query is relayed.
+func (a *udpAssociation) sendDNSAnswer(client net.Addr, source *address, answer *dnsmessage.Message) bool {
+	data, err := answer.Pack()
+	if err != nil {
+		a.server.logger.Error(a.ctx, "failed to pack dns answer", LogKeyError, err)
+		return false
+	}
+
+	a.sendReply(client, source, data)
+
+	return true
+}
+
+// dnsQuestionName returns the name of the question the rules apply to, in
+// lower case as the resolvers mix the case of the names they query.
+func dnsQuestionName(question dnsmessage.Question) string {
+	return strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+}
+
+// blockedDNSAnswer answers the question for a blocked name with NXDOMAIN, or
+// with the sinkhole address of the family of an A or AAAA question when it is set.
+func (s *Server) blockedDNSAnswer(query *dnsmessage.Message, question dnsmessage.Question) *dnsmessage.Message {
+	var sinkhole net.IP
+
+	switch question.Type {
+	case dnsmessage.TypeA:
+		sinkhole = s.config.dnsSinkholeIPv4
+	case dnsmessage.TypeAAAA:
+		sinkhole = s.config.dnsSinkholeIPv6
+	}
+
+	if sinkhole == nil {
+		return dnsAnswer(query, question, dnsmessage.RCodeNameError, nil)
+	}
+
+	return dnsAnswer(query, question, dnsmessage.RCodeSuccess, []net.IP{sinkhole})
+}
+
+// localDNSNetwork returns the network of the lookup that answers an A or AAAA
+// query with the Resolver of the server, the other queries are relayed.
+func localDNSNetwork(query *dnsmessage.Message) (string, bool) {
+	question := query.Questions[0]
+
+	switch {
+	case len(query.Questions) != 1 || question.Class != dnsmessage.ClassINET:
+		return "", false
+	case question.Type == dnsmessage.TypeA:
+		return "ip4", true
+	case question.Type == dnsmessage.TypeAAAA:
+		return "ip6", true
+	default:
+		return "", false
+	}
+}
+
+// localDNSAnswer answers the query with the Resolver of the server.
+func (s *Server) localDNSAnswer(ctx context.Context, query *dnsmessage.Message, network string) *dnsmessage.Message {
+	question := query.Questions[0]
+
+	ips, err := s.resolver.LookupIP(ctx, network, dnsQuestionName(question))
+
+	switch {
+	case isNotFoundError(err):
+		return dnsAnswer(query, question, dnsmessage.RCodeNameError, nil)
+	case err != nil:
+		s.logger.Error(ctx, "failed to resolve dns query", LogKeyDestination, question.Name.String(), LogKeyError, err)
+
+		return dnsAnswer(query, question, dnsmessage.RCodeServerFailure, nil)
+	}
+
+	return dnsAnswer(query, question, dnsmessage.RCodeSuccess, ips)
+}
+
+// dnsAnswer returns the answer to the question of the query
+// with the IPs of its family.
+func dnsAnswer(query *dnsmessage.Message, question dnsmessage.Question, rcode dnsmessage.RCode, ips []net.IP) *dnsmessage.Message {
+	answer := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 query.Header.ID,
+			Response:           true,
+			OpCode:             query.Header.OpCode,
+			RecursionDesired:   query.Header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{
+			Name:  question.Name,
+			Type:  question.Type,
+			Class: dnsmessage.ClassINET,
+			TTL:   interceptedTTL,
+		}
+
+		switch ip4 := ip.To4(); {
+		case question.Type == dnsmessage.TypeA && ip4 != nil:
+			resource := &dnsmessage.AResource{}
+			copy(resource.A[:], ip4)
+
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: resource})
+		case question.Type == dnsmessage.TypeAAAA && ip4 == nil && len(ip) == net.IPv6len:
+			resource := &dnsmessage.AAAAResource{}
+			copy(resource.AAAA[:], ip)
+
+			answer.Answers = append(answer.Answers, dnsmessage.Resource{Header: header, Body: resource})
+		}
+	}
+
+	return answer
+}
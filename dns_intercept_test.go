@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newTestDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+
+	return &dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+}
+
+func TestDNSAnswer(t *testing.T) {
+	query := newTestDNSQuery(t, "example.com.", dnsmessage.TypeA)
+
+	answer := dnsAnswer(query, query.Questions[0], dnsmessage.RCodeSuccess, []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::1"),
+	})
+
+	assert.Equal(t, uint16(0x1234), answer.Header.ID)
+	assert.True(t, answer.Header.Response)
+	assert.True(t, answer.Header.RecursionDesired)
+	assert.Equal(t, query.Questions, answer.Questions)
+
+	// Only the IPs of the family of the question are answered.
+	require.Len(t, answer.Answers, 1)
+	assert.Equal(t, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}, answer.Answers[0].Body)
+
+	_, err := answer.Pack()
+	require.NoError(t, err)
+}
+
+func TestBlockedDNSAnswer(t *testing.T) {
+	s := &Server{config: &config{dnsSinkholeIPv4: net.ParseIP("0.0.0.0")}}
+
+	query := newTestDNSQuery(t, "blocked.test.", dnsmessage.TypeA)
+
+	answer := s.blockedDNSAnswer(query, query.Questions[0])
+
+	assert.Equal(t, dnsmessage.RCodeSuccess, answer.Header.RCode)
+	require.Len(t, answer.Answers, 1)
+	assert.Equal(t, &dnsmessage.AResource{}, answer.Answers[0].Body)
+
+	// Without a sinkhole of the family the name does not exist.
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeMX} {
+		query := newTestDNSQuery(t, "blocked.test.", qtype)
+
+		answer = s.blockedDNSAnswer(query, query.Questions[0])
+
+		assert.Equal(t, dnsmessage.RCodeNameError, answer.Header.RCode)
+		assert.Empty(t, answer.Answers)
+	}
+}
+
+func TestBlockedDNSAnswerMatchedQuestion(t *testing.T) {
+	s := &Server{config: &config{dnsSinkholeIPv4: net.ParseIP("0.0.0.0")}}
+
+	query := newTestDNSQuery(t, "allowed.test.", dnsmessage.TypeA)
+	query.Questions = append(query.Questions, dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("BlOcKeD.test."),
+		Type:  dnsmessage.TypeA,
+		Class: dnsmessage.ClassINET,
+	})
+
+	answer := s.blockedDNSAnswer(query, query.Questions[1])
+
+	// The answer is for the blocked question, in the case the client sent.
+	assert.Equal(t, query.Questions[1:], answer.Questions)
+	require.Len(t, answer.Answers, 1)
+	assert.Equal(t, "BlOcKeD.test.", answer.Answers[0].Header.Name.String())
+	assert.Equal(t, "blocked.test", dnsQuestionName(query.Questions[1]))
+}
@@ -1,8 +1,10 @@
 package socks5
 
 import (
+	"context"
 	"errors"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -13,8 +15,19 @@ type Driver interface {
 	Resolve(network, address string) (net.Addr, error)
 }
 
+// ContextPacketListener is an optional interface of Driver. The server opens
+// the UDP relay socket with it when the Driver implements it, the context
+// carries the values of the session such as the username.
+type ContextPacketListener interface {
+	ListenPacketContext(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
 type netDriver struct {
-	timeout time.Duration
+	timeout      time.Duration
+	attemptDelay time.Duration
+	preference   IPPreference
+	resolver     Resolver
+	selector     SourceSelector
 }
 
 func (d *netDriver) Listen(network, address string) (net.Listener, error) {
@@ -22,18 +35,140 @@ func (d *netDriver) Listen(network, address string) (net.Listener, error) {
 }
 
 func (d *netDriver) ListenPacket(network, address string) (net.PacketConn, error) {
-	return net.ListenPacket(network, address)
+	return d.ListenPacketContext(context.Background(), network, address)
+}
+
+// ListenPacketContext binds the relay socket to the address, the datagrams
+// to the destinations leave from the addresses picked by the source selector.
+func (d *netDriver) ListenPacketContext(ctx context.Context, network, address string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+
+	conn, err := lc.ListenPacket(ctx, network, address)
+	if err != nil || d.selector == nil {
+		return conn, err
+	}
+
+	return newEgressPacketConn(ctx, network, conn, d.selector), nil
 }
 
 func (d *netDriver) Dial(network, address string) (net.Conn, error) {
-	return net.DialTimeout(network, address, d.timeout)
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext resolves the host with the resolver and races connection
+// attempts to the addresses with the Happy Eyeballs algorithm, RFC 8305.
+// When every attempt fails the error is a *DialError.
+func (d *netDriver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookupIP(ctx, network, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	ips = interleaveFamilies(ips, d.preference)
+	if len(ips) == 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	}
+
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+
+	dialer := &sourceDialer{
+		dialer: net.Dialer{
+			Timeout: d.timeout,
+		},
+	}
+
+	if d.selector != nil {
+		dialer.selector = newFamilySource(d.selector)
+	}
+
+	return dialHappyEyeballs(ctx, dialer, network, address, addresses, d.attemptDelay)
 }
 
 func (d *netDriver) Resolve(network, address string) (net.Addr, error) {
 	switch network {
-	case "udp":
-		return net.ResolveUDPAddr(network, address)
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
 	default:
 		return nil, errors.New("bad network")
 	}
+
+	host, portName, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.LookupPort(network, portName)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookupIP(context.Background(), network, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a preference IPv4 comes first, as with net.ResolveUDPAddr.
+	preference := d.preference
+	if preference == PreferNone {
+		preference = PreferIPv4
+	}
+
+	ips = interleaveFamilies(ips, preference)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ips[0], Port: port}, nil
+	}
+
+	return &net.TCPAddr{IP: ips[0], Port: port}, nil
+}
+
+func (d *netDriver) lookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	return d.resolver.LookupIP(ctx, ipNetwork(network), host)
+}
+
+// ipNetwork maps a dial network to the network of a name lookup.
+func ipNetwork(network string) string {
+	switch {
+	case strings.HasSuffix(network, "4"):
+		return "ip4"
+	case strings.HasSuffix(network, "6"):
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// LookupAddr asks the resolver for the names of the IP address. A Resolver
+// without reverse lookups does not fall back to the system resolver, so that
+// the lookups do not bypass an encrypted upstream.
+func (d *netDriver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	switch resolver := d.resolver.(type) {
+	case *systemResolver:
+		return net.DefaultResolver.LookupAddr(ctx, ip.String())
+	case ReverseResolver:
+		return resolver.LookupAddr(ctx, ip)
+	default:
+		return nil, errReverseLookupNotSupported
+	}
 }
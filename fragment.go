@@ -0,0 +1,139 @@
+package socks5
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// fragmentEnd is the high bit of the FRAG field that ends a fragment sequence.
+	fragmentEnd         byte = 0x80
+	maxFragmentPosition      = 127
+	// reassemblyTimeout is the reassembly timer, RFC 1928 requires at least 5 seconds.
+	reassemblyTimeout = 5 * time.Second
+	// maxReassemblySize is the largest payload of a UDP datagram over IPv4.
+	maxReassemblySize = 65507
+)
+
+var (
+	errFragmentMTU          = errors.New("mtu is too small for the datagram header")
+	errTooManyFragments     = errors.New("datagram needs more than 127 fragments")
+	errReassemblyOverflow   = errors.New("reassembled datagram is too large")
+	errFragmentationOff     = errors.New("not support fragmentation")
+	errFragmentOutOfOrder   = errors.New("fragment position is lower than the previous one")
+	errReassemblyTimedOut   = errors.New("reassembly timer expired")
+	errFragmentPositionZero = errors.New("fragment position is zero")
+)
+
+// reassembler is the reassembly queue of a UDP association, RFC 1928 section 7.
+// It holds at most one sequence of at most maxReassemblySize bytes.
+type reassembler struct {
+	address   *address
+	fragments [][]byte
+	position  byte
+	size      int
+	deadline  time.Time
+	now       func() time.Time
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{now: time.Now}
+}
+
+// add queues the fragment and returns the reassembled datagram once the fragment
+// that ends the sequence arrives. The queue is discarded when the timer expires
+// or a fragment has a lower position than the previous one, the returned error
+// tells why the queued fragments were dropped.
+func (r *reassembler) add(p *packet) (*packet, error) {
+	position := p.frag &^ fragmentEnd
+	if position == 0 {
+		return nil, errFragmentPositionZero
+	}
+
+	var dropErr error
+
+	switch {
+	case len(r.fragments) > 0 && r.now().After(r.deadline):
+		dropErr = errReassemblyTimedOut
+		r.reset()
+	case len(r.fragments) > 0 && position <= r.position:
+		dropErr = errFragmentOutOfOrder
+		r.reset()
+	}
+
+	if len(r.fragments) == 0 {
+		r.address = p.address
+		r.deadline = r.now().Add(reassemblyTimeout)
+	}
+
+	if r.size+len(p.payload) > maxReassemblySize {
+		r.reset()
+		return nil, errReassemblyOverflow
+	}
+
+	r.fragments = append(r.fragments, append([]byte(nil), p.payload...))
+	r.position = position
+	r.size += len(p.payload)
+
+	if p.frag&fragmentEnd == 0 {
+		return nil, dropErr
+	}
+
+	datagram := &packet{
+		address: r.address,
+		payload: make(payload, 0, r.size),
+	}
+
+	for _, fragment := range r.fragments {
+		datagram.payload = append(datagram.payload, fragment...)
+	}
+
+	r.reset()
+
+	return datagram, nil
+}
+
+// reset discards the queue, a standalone datagram resets it as well.
+func (r *reassembler) reset() {
+	r.address = nil
+	r.fragments = nil
+	r.position = 0
+	r.size = 0
+}
+
+// fragment encodes the datagram from the address as fragments that fit in the mtu,
+// a datagram that fits is encoded as a standalone datagram.
+func fragment(addr *address, data []byte, mtu int) ([][]byte, error) {
+	p := packet{address: addr}
+	p.encode(data)
+
+	if mtu <= 0 || len(p.payload) <= mtu {
+		return [][]byte{p.payload}, nil
+	}
+
+	chunk := mtu - (len(p.payload) - len(data))
+	if chunk <= 0 {
+		return nil, errFragmentMTU
+	}
+
+	count := (len(data) + chunk - 1) / chunk
+	if count > maxFragmentPosition {
+		return nil, errTooManyFragments
+	}
+
+	fragments := make([][]byte, 0, count)
+
+	for i := range count {
+		end := min((i+1)*chunk, len(data))
+
+		p.frag = byte(i + 1)
+		if i == count-1 {
+			p.frag |= fragmentEnd
+		}
+
+		p.encode(data[i*chunk : end])
+		fragments = append(fragments, p.payload)
+	}
+
+	return fragments, nil
+}
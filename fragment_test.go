@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReassembler(t *testing.T) {
+	addr, err := parseAddress("192.0.2.1:53")
+	require.NoError(t, err)
+
+	fragments, err := fragment(addr, []byte("hello fragmented world"), 20)
+	require.NoError(t, err)
+	require.Greater(t, len(fragments), 1)
+
+	decode := func(data []byte) *packet {
+		var p packet
+		require.NoError(t, p.decode(data))
+
+		return &p
+	}
+
+	t.Run("in_order", func(t *testing.T) {
+		r := newReassembler()
+
+		for _, data := range fragments[:len(fragments)-1] {
+			datagram, err := r.add(decode(data))
+			require.NoError(t, err)
+			assert.Nil(t, datagram)
+		}
+
+		datagram, err := r.add(decode(fragments[len(fragments)-1]))
+		require.NoError(t, err)
+		require.NotNil(t, datagram)
+		assert.Equal(t, "hello fragmented world", string(datagram.payload))
+		assert.Equal(t, addr.String(), datagram.address.String())
+	})
+
+	t.Run("lower_position_restarts", func(t *testing.T) {
+		r := newReassembler()
+
+		_, err := r.add(decode(fragments[0]))
+		require.NoError(t, err)
+		_, err = r.add(decode(fragments[1]))
+		require.NoError(t, err)
+
+		// The first fragment again starts a new sequence.
+		_, err = r.add(decode(fragments[0]))
+		assert.ErrorIs(t, err, errFragmentOutOfOrder)
+
+		var datagram *packet
+		for _, data := range fragments[1:] {
+			datagram, err = r.add(decode(data))
+			require.NoError(t, err)
+		}
+
+		require.NotNil(t, datagram)
+		assert.Equal(t, "hello fragmented world", string(datagram.payload))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		now := time.Now()
+
+		r := newReassembler()
+		r.now = func() time.Time { return now }
+
+		_, err := r.add(decode(fragments[0]))
+		require.NoError(t, err)
+
+		now = now.Add(reassemblyTimeout + time.Second)
+
+		// The queue expired, so the sequence misses its first fragment.
+		_, err = r.add(decode(fragments[1]))
+		assert.ErrorIs(t, err, errReassemblyTimedOut)
+		assert.Len(t, r.fragments, 1)
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		r := newReassembler()
+
+		big := &packet{address: addr, frag: 1, payload: make(payload, maxReassemblySize)}
+
+		_, err := r.add(big)
+		require.NoError(t, err)
+
+		big.frag = 2 | fragmentEnd
+
+		datagram, err := r.add(big)
+		assert.ErrorIs(t, err, errReassemblyOverflow)
+		assert.Nil(t, datagram)
+		assert.Empty(t, r.fragments)
+	})
+
+	t.Run("position_zero", func(t *testing.T) {
+		_, err := newReassembler().add(&packet{address: addr, frag: fragmentEnd})
+		assert.ErrorIs(t, err, errFragmentPositionZero)
+	})
+}
+
+func TestFragment(t *testing.T) {
+	addr, err := parseAddress("192.0.2.1:53")
+	require.NoError(t, err)
+
+	data := bytes.Repeat([]byte("x"), 100)
+
+	// The IPv4 header takes 10 bytes.
+	fragments, err := fragment(addr, data, 40)
+	require.NoError(t, err)
+	require.Len(t, fragments, 4)
+
+	var joined []byte
+
+	for i, datagram := range fragments {
+		assert.LessOrEqual(t, len(datagram), 40)
+
+		var p packet
+		require.NoError(t, p.decode(datagram))
+
+		assert.Equal(t, byte(i+1), p.frag&^fragmentEnd)
+		assert.Equal(t, i == len(fragments)-1, p.frag&fragmentEnd != 0)
+
+		joined = append(joined, p.payload...)
+	}
+
+	assert.Equal(t, data, joined)
+
+	// A datagram that fits is not fragmented.
+	fragments, err = fragment(addr, data, 0)
+	require.NoError(t, err)
+	require.Len(t, fragments, 1)
+	assert.Equal(t, byte(0), fragments[0][2])
+
+	_, err = fragment(addr, data, 10)
+	assert.ErrorIs(t, err, errFragmentMTU)
+
+	_, err = fragment(addr, bytes.Repeat([]byte("x"), 1000), 11)
+	assert.ErrorIs(t, err, errTooManyFragments)
+}
@@ -0,0 +1,115 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Reply codes of a SOCKS request, RFC 1928 section 6.
+const (
+	ReplySucceeded               = ReplyCode(connectionSuccessful)
+	ReplyGeneralFailure          = ReplyCode(generalSOCKSserverFailure)
+	ReplyNotAllowedByRuleSet     = ReplyCode(connectionNotAllowedByRuleSet)
+	ReplyNetworkUnreachable      = ReplyCode(networkUnreachable)
+	ReplyHostUnreachable         = ReplyCode(hostUnreachable)
+	ReplyConnectionRefused       = ReplyCode(connectionRefused)
+	ReplyCommandNotSupported     = ReplyCode(commandNotSupported)
+	ReplyAddressTypeNotSupported = ReplyCode(addressTypeNotSupported)
+)
+
+var errAlreadyReplied = errors.New("reply has already been sent")
+
+type ReplyCode byte
+
+func (c ReplyCode) String() string {
+	return replyName(byte(c))
+}
+
+// Request is a SOCKS request that passed the rules.
+type Request struct {
+	Command Command
+	// Destination is the requested host:port, a middleware can rewrite it
+	// to change the destination used by the built-in handlers.
+	Destination string
+	RemoteAddr  net.Addr
+
+	conn *connection
+	addr *address
+}
+
+// address returns the destination as it is encoded in the protocol.
+func (r *Request) address() (*address, error) {
+	if r.addr != nil && r.Destination == r.addr.String() {
+		return r.addr, nil
+	}
+
+	return parseAddress(r.Destination)
+}
+
+// ReplyWriter sends the reply to a request, only the first reply is sent.
+type ReplyWriter interface {
+	// Reply sends the reply code with the bound host:port,
+	// an empty bound address echoes the requested destination.
+	Reply(code ReplyCode, bound string) error
+}
+
+// Handler serves a SOCKS request. A handler must reply to the request,
+// the server replies with a general failure to an unanswered request.
+type Handler interface {
+	ServeSOCKS(ctx context.Context, req *Request, w ReplyWriter)
+}
+
+type HandlerFunc func(ctx context.Context, req *Request, w ReplyWriter)
+
+func (f HandlerFunc) ServeSOCKS(ctx context.Context, req *Request, w ReplyWriter) {
+	f(ctx, req, w)
+}
+
+// Middleware wraps a Handler to add behavior around request handling.
+type Middleware func(next Handler) Handler
+
+// Use appends middleware to the chain around the built-in CONNECT and
+// UDP ASSOCIATE handlers, the first middleware is the outermost one.
+// It must be called before the server starts.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+
+	var handler Handler = HandlerFunc(s.serveRequest)
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+
+	s.handler = handler
+}
+
+type replyWriter struct {
+	server  *Server
+	ctx     context.Context
+	req     *Request
+	replied bool
+}
+
+func (w *replyWriter) Reply(code ReplyCode, bound string) error {
+	if w.replied {
+		return errAlreadyReplied
+	}
+
+	addr := w.req.addr
+
+	if bound != "" {
+		var err error
+
+		addr, err = parseAddress(bound)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.replied = true
+
+	w.server.replyRequest(w.ctx, w.req.conn, byte(code), addr)
+
+	return nil
+}
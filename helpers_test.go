@@ -1,13 +1,17 @@
 package socks5_test
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"testing"
 	"time"
 
+	"github.com/stretchr/testify/require"
 	"golang.org/x/net/proxy"
 
 	"github.com/TuanKiri/socks5"
@@ -101,6 +105,83 @@ func (d testTLSDriver) Resolve(network, address string) (net.Addr, error) {
 	return nil, nil
 }
 
+// testBlockingDriver blocks every dial until its context is canceled.
+type testBlockingDriver struct {
+	canceled chan error
+}
+
+func (d *testBlockingDriver) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (d *testBlockingDriver) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+func (d *testBlockingDriver) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func (d *testBlockingDriver) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	<-ctx.Done()
+
+	d.canceled <- ctx.Err()
+
+	return nil, ctx.Err()
+}
+
+func (d *testBlockingDriver) Resolve(network, address string) (net.Addr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+// testSniffingDriver records the sniffed host of every dial.
+type testSniffingDriver struct {
+	hosts chan string
+}
+
+func (d *testSniffingDriver) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (d *testSniffingDriver) ListenPacket(network, address string) (net.PacketConn, error) {
+	return net.ListenPacket(network, address)
+}
+
+func (d *testSniffingDriver) Dial(network, address string) (net.Conn, error) {
+	return net.Dial(network, address)
+}
+
+func (d *testSniffingDriver) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, _ := socks5.SniffedHostFromContext(ctx)
+	d.hosts <- host
+
+	var dialer net.Dialer
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (d *testSniffingDriver) Resolve(network, address string) (net.Addr, error) {
+	return net.ResolveUDPAddr(network, address)
+}
+
+type testAccessLogger struct {
+	records chan socks5.AccessRecord
+}
+
+func (l *testAccessLogger) LogAccess(_ context.Context, record socks5.AccessRecord) {
+	l.records <- record
+}
+
+type testReplyWriter struct {
+	socks5.ReplyWriter
+	replies chan socks5.ReplyCode
+}
+
+func (w *testReplyWriter) Reply(code socks5.ReplyCode, bound string) error {
+	w.replies <- code
+	return w.ReplyWriter.Reply(code, bound)
+}
+
 func listenAndServeTLS(address string, handler http.Handler) error {
 	server := http.Server{
 		Addr: address,
@@ -175,3 +256,107 @@ func echoPacketServer(address string) error {
 		}
 	}
 }
+
+// associateUDP sends a UDP ASSOCIATE request to the proxy and returns
+// a socket connected to the relay, the association lasts for the test.
+func associateUDP(t *testing.T, proxyAddress string) *net.UDPConn {
+	t.Helper()
+
+	// UDP ASSOCIATE 0.0.0.0:0
+	relay := requestUDPAssociate(t, proxyAddress, udpHeader(&net.UDPAddr{IP: net.IPv4zero})[3:])
+
+	udpConn, err := net.DialUDP("udp", nil, relay)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		udpConn.Close()
+	})
+
+	return udpConn
+}
+
+// testAddr is a UDP host:port that can hold a domain name.
+type testAddr string
+
+func (a testAddr) Network() string { return "udp" }
+func (a testAddr) String() string  { return string(a) }
+
+// requestUDPAssociate sends a UDP ASSOCIATE request with the client address
+// to the proxy and returns the relay address of the reply.
+func requestUDPAssociate(t *testing.T, proxyAddress string, clientAddress []byte) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(t, err)
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	_, err = conn.Write(append([]byte{0x05, 0x03, 0x00}, clientAddress...))
+	require.NoError(t, err)
+
+	reply = make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x00), reply[1])
+
+	ipLen := net.IPv4len
+	if reply[3] == 0x04 {
+		ipLen = net.IPv6len
+	}
+
+	bound := make([]byte, ipLen+2)
+	_, err = io.ReadFull(conn, bound)
+	require.NoError(t, err)
+
+	return &net.UDPAddr{
+		IP:   net.IP(bound[:ipLen]),
+		Port: int(bound[ipLen])<<8 | int(bound[ipLen+1]),
+	}
+}
+
+// udpHeader returns the header of a datagram to an IPv4 destination.
+func udpHeader(addr *net.UDPAddr) []byte {
+	header := []byte{0x00, 0x00, 0x00, 0x01}
+	header = append(header, addr.IP.To4()...)
+
+	return append(header, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// udpHeaderSource returns the IPv4 address of a datagram header.
+func udpHeaderSource(datagram []byte) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IP(datagram[4:8]),
+		Port: int(datagram[8])<<8 | int(datagram[9]),
+	}
+}
+
+// failingStore fails every password lookup, as a store does for an unknown user.
+type failingStore struct{}
+
+func (failingStore) GetPassword(_ context.Context, _ string) (string, error) {
+	return "", errors.New("user not found")
+}
+
+// delayedResolver answers every lookup with the IP after the delay.
+type delayedResolver struct {
+	delay time.Duration
+	ip    net.IP
+}
+
+func (r delayedResolver) LookupIP(ctx context.Context, _, _ string) ([]net.IP, error) {
+	select {
+	case <-time.After(r.delay):
+		return []net.IP{r.ip}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
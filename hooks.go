@@ -0,0 +1,195 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultHookTimeout = time.Second
+
+var errHookFailed = errors.New("hook failed")
+
+// Hooks are callbacks invoked at the lifecycle stages of a session, every
+// callback receives the session context and any of them can be nil.
+//
+// A hook that panics is recovered and a hook that runs longer than Timeout is
+// abandoned, the server carries on without it. OnRequest is the exception:
+// a request is denied when its hook panics or times out.
+type Hooks struct {
+	// OnAccept is called when a client connection is accepted.
+	OnAccept func(ctx context.Context, addr net.Addr)
+	// OnAuth is called when the authentication method has been negotiated
+	// and, for username/password authentication, the credentials checked.
+	OnAuth func(ctx context.Context, user string, method byte, ok bool)
+	// OnRequest is called for every request allowed by the rules,
+	// returning an error denies the request.
+	OnRequest func(ctx context.Context, cmd Command, addr string) error
+	// OnDial is called after the destination of a CONNECT request is dialed.
+	OnDial func(ctx context.Context, addr string, resolved net.Addr, err error)
+	// OnDialAttempt is called for every finished connection attempt to
+	// a resolved address of the destination, before OnDial.
+	OnDialAttempt func(ctx context.Context, attempt DialAttempt)
+	// OnClose is called when the client connection is closed.
+	OnClose func(ctx context.Context, stats AccessRecord)
+	// Timeout bounds the time the server waits for a hook, one second by default.
+	Timeout time.Duration
+}
+
+type hooks struct {
+	Hooks
+	logger Logger
+}
+
+func newHooks(h Hooks, logger Logger) *hooks {
+	if h.Timeout <= 0 {
+		h.Timeout = defaultHookTimeout
+	}
+
+	return &hooks{
+		Hooks:  h,
+		logger: logger,
+	}
+}
+
+func (h *hooks) onAccept(ctx context.Context, addr net.Addr) {
+	if h.OnAccept == nil {
+		return
+	}
+
+	h.run(ctx, "OnAccept", func() error {
+		h.OnAccept(ctx, addr)
+		return nil
+	})
+}
+
+func (h *hooks) onAuth(ctx context.Context, user string, method byte, ok bool) {
+	if h.OnAuth == nil {
+		return
+	}
+
+	h.run(ctx, "OnAuth", func() error {
+		h.OnAuth(ctx, user, method, ok)
+		return nil
+	})
+}
+
+// onRequest reports whether the request is allowed by the hook.
+func (h *hooks) onRequest(ctx context.Context, cmd byte, addr string) bool {
+	if h.OnRequest == nil {
+		return true
+	}
+
+	err := h.run(ctx, "OnRequest", func() error {
+		return h.OnRequest(ctx, Command(cmd), addr)
+	})
+	if err != nil && !errors.Is(err, errHookFailed) {
+		h.logger.Info(ctx, "request denied by hook", LogKeyError, err)
+	}
+
+	return err == nil
+}
+
+func (h *hooks) onDial(ctx context.Context, addr string, resolved net.Addr, dialErr error) {
+	if h.OnDial == nil {
+		return
+	}
+
+	h.run(ctx, "OnDial", func() error {
+		h.OnDial(ctx, addr, resolved, dialErr)
+		return nil
+	})
+}
+
+func (h *hooks) onDialAttempt(ctx context.Context, attempt DialAttempt) {
+	if h.OnDialAttempt == nil {
+		return
+	}
+
+	h.run(ctx, "OnDialAttempt", func() error {
+		h.OnDialAttempt(ctx, attempt)
+		return nil
+	})
+}
+
+func (h *hooks) onClose(ctx context.Context, stats AccessRecord) {
+	if h.OnClose == nil {
+		return
+	}
+
+	h.run(ctx, "OnClose", func() error {
+		h.OnClose(ctx, stats)
+		return nil
+	})
+}
+
+// hookQueue runs hooks one after another in a separate goroutine,
+// in the order they are pushed.
+type hookQueue struct {
+	mutex sync.Mutex
+	// last is closed when the last pushed hook is done.
+	last chan struct{}
+}
+
+func (q *hookQueue) push(fn func()) {
+	done := make(chan struct{})
+
+	q.mutex.Lock()
+	prev := q.last
+	q.last = done
+	q.mutex.Unlock()
+
+	go func() {
+		defer close(done)
+
+		if prev != nil {
+			<-prev
+		}
+
+		fn()
+	}()
+}
+
+// wait waits for the hooks pushed so far.
+func (q *hookQueue) wait() {
+	q.mutex.Lock()
+	last := q.last
+	q.mutex.Unlock()
+
+	if last != nil {
+		<-last
+	}
+}
+
+// run calls the hook in a separate goroutine, recovering a panic
+// and giving up on waiting once the timeout expires.
+func (h *hooks) run(ctx context.Context, name string, fn func() error) error {
+	result := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				h.logger.Error(ctx, "hook panicked", "hook", name, LogKeyError, fmt.Sprint(r))
+
+				result <- errHookFailed
+			}
+		}()
+
+		result <- fn()
+	}()
+
+	timer := time.NewTimer(h.Timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		h.logger.Warn(ctx, "hook timed out", "hook", name)
+
+		return errHookFailed
+	}
+}
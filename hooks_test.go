@@ -0,0 +1,85 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooksFailures(t *testing.T) {
+	h := newHooks(Hooks{
+		OnAccept: func(_ context.Context, _ net.Addr) {
+			panic("boom")
+		},
+		OnRequest: func(_ context.Context, cmd Command, _ string) error {
+			switch cmd {
+			case Connect:
+				return nil
+			case Bind:
+				return errors.New("bind is forbidden")
+			default:
+				time.Sleep(time.Second)
+				return nil
+			}
+		},
+		Timeout: 50 * time.Millisecond,
+	}, NopLogger)
+
+	ctx := context.Background()
+
+	assert.NotPanics(t, func() {
+		h.onAccept(ctx, &net.TCPAddr{})
+	})
+
+	assert.True(t, h.onRequest(ctx, connect, "example.com:80"))
+	assert.False(t, h.onRequest(ctx, bind, "example.com:80"))
+
+	start := time.Now()
+
+	assert.False(t, h.onRequest(ctx, udpAssociate, "example.com:80"))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestHooksDefaults(t *testing.T) {
+	h := newHooks(Hooks{}, NopLogger)
+
+	assert.Equal(t, defaultHookTimeout, h.Timeout)
+	assert.True(t, h.onRequest(context.Background(), connect, "example.com:80"))
+
+	assert.NotPanics(t, func() {
+		h.onClose(context.Background(), AccessRecord{})
+	})
+}
+
+func TestHookQueue(t *testing.T) {
+	var (
+		q     hookQueue
+		order []int
+	)
+
+	release := make(chan struct{})
+
+	start := time.Now()
+
+	for i := range 3 {
+		q.push(func() {
+			if i == 0 {
+				<-release
+			}
+
+			order = append(order, i)
+		})
+	}
+
+	// Pushing does not wait for a slow hook.
+	assert.Less(t, time.Since(start), 100*time.Millisecond)
+
+	close(release)
+	q.wait()
+
+	assert.Equal(t, []int{0, 1, 2}, order)
+}
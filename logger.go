@@ -4,14 +4,59 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
+	"strconv"
+	"strings"
 )
 
+// Keys of the structured attributes passed to the Logger.
+const (
+	LogKeySessionID     = "session_id"
+	LogKeyRemoteAddress = "remote_addr"
+	LogKeyUser          = "user"
+	LogKeyCommand       = "command"
+	LogKeyDestination   = "destination"
+	LogKeyResolved      = "resolved"
+	LogKeyError         = "error"
+	LogKeySniffedHost   = "sniffed_host"
+)
+
+// Logger receives messages with structured attributes, args are
+// alternating keys and values as in log/slog.
 type Logger interface {
 	Info(ctx context.Context, msg string, args ...any)
 	Warn(ctx context.Context, msg string, args ...any)
 	Error(ctx context.Context, msg string, args ...any)
 }
 
+// ContextAttributes returns the session values stored in the context
+// as alternating keys and values, ready to be appended to log args.
+func ContextAttributes(ctx context.Context) []any {
+	var args []any
+
+	if sessionID, ok := SessionIDFromContext(ctx); ok {
+		args = append(args, LogKeySessionID, sessionID)
+	}
+
+	if remoteAddress, ok := RemoteAddressFromContext(ctx); ok {
+		args = append(args, LogKeyRemoteAddress, remoteAddress.String())
+	}
+
+	if username, ok := UsernameFromContext(ctx); ok {
+		args = append(args, LogKeyUser, username)
+	}
+
+	if command, ok := CommandFromContext(ctx); ok {
+		args = append(args, LogKeyCommand, command.String())
+	}
+
+	if destination, ok := DestinationFromContext(ctx); ok {
+		args = append(args, LogKeyDestination, destination)
+	}
+
+	return args
+}
+
 type stdoutLogger struct {
 	log *log.Logger
 }
@@ -29,13 +74,59 @@ func (l *stdoutLogger) Error(ctx context.Context, msg string, args ...any) {
 }
 
 func (l *stdoutLogger) print(ctx context.Context, level, msg string, args ...any) {
-	output := fmt.Sprintf("- %s - %s %s", level, msg, fmt.Sprintln(args...))
+	var output strings.Builder
 
-	if remoteAddress, ok := RemoteAddressFromContext(ctx); ok {
-		output = fmt.Sprintf("- %s %s", remoteAddress, output)
+	fmt.Fprintf(&output, "- %s - %s", level, msg)
+
+	writeAttributes(&output, ContextAttributes(ctx))
+	writeAttributes(&output, args)
+
+	l.log.Print(output.String())
+}
+
+func writeAttributes(b *strings.Builder, args []any) {
+	for len(args) > 0 {
+		key, value := "!BADKEY", args[0]
+
+		if k, ok := args[0].(string); ok && len(args) > 1 {
+			key, value = k, args[1]
+			args = args[1:]
+		}
+
+		args = args[1:]
+
+		fmt.Fprintf(b, " %s=%s", key, quoteValue(fmt.Sprint(value)))
 	}
+}
+
+func quoteValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+// NewSlogLogger adapts a log/slog logger to the Logger interface,
+// the session values stored in the context are added to every record.
+func NewSlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{log: l}
+}
+
+type slogLogger struct {
+	log *slog.Logger
+}
+
+func (l *slogLogger) Info(ctx context.Context, msg string, args ...any) {
+	l.log.InfoContext(ctx, msg, append(ContextAttributes(ctx), args...)...)
+}
+
+func (l *slogLogger) Warn(ctx context.Context, msg string, args ...any) {
+	l.log.WarnContext(ctx, msg, append(ContextAttributes(ctx), args...)...)
+}
 
-	l.log.Print(output)
+func (l *slogLogger) Error(ctx context.Context, msg string, args ...any) {
+	l.log.ErrorContext(ctx, msg, append(ContextAttributes(ctx), args...)...)
 }
 
 type nopLogger struct{}
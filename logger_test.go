@@ -0,0 +1,61 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdoutLogger(t *testing.T) {
+	var buff bytes.Buffer
+
+	logger := &stdoutLogger{
+		log: log.New(&buff, "", 0),
+	}
+
+	logger.Error(testLogContext(), "failed to dial destination", LogKeyError, errors.New("connection refused"), "odd")
+
+	assert.Equal(t,
+		"- ERROR - failed to dial destination remote_addr=127.0.0.1:5000 user=root command=connect "+
+			"destination=localhost:80 error=\"connection refused\" !BADKEY=odd\n",
+		buff.String(),
+	)
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buff bytes.Buffer
+
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(&buff, nil)))
+
+	logger.Warn(testLogContext(), "failed to authenticate user", LogKeyError, "invalid password")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buff.Bytes(), &record))
+
+	assert.Equal(t, "WARN", record["level"])
+	assert.Equal(t, "failed to authenticate user", record["msg"])
+	assert.Equal(t, "127.0.0.1:5000", record[LogKeyRemoteAddress])
+	assert.Equal(t, "root", record[LogKeyUser])
+	assert.Equal(t, "connect", record[LogKeyCommand])
+	assert.Equal(t, "localhost:80", record[LogKeyDestination])
+	assert.Equal(t, "invalid password", record[LogKeyError])
+}
+
+func testLogContext() context.Context {
+	ctx := contextWithRemoteAddress(context.Background(), &net.TCPAddr{
+		IP:   net.ParseIP("127.0.0.1"),
+		Port: 5000,
+	})
+	ctx = contextWithUsername(ctx, "root")
+	ctx = contextWithCommand(ctx, connect)
+
+	return contextWithDestination(ctx, "localhost:80")
+}
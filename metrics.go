@@ -1,13 +1,64 @@
 package socks5
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Metrics interface {
 	UploadBytes(ctx context.Context, n int64)
 	DownloadBytes(ctx context.Context, n int64)
 }
 
+// ExtendedMetrics is an optional interface that a Metrics implementation can
+// satisfy to receive every instrumentation point of a session. The command and
+// the username, when known, are available from the context.
+type ExtendedMetrics interface {
+	Metrics
+	ConnectionOpened(ctx context.Context)
+	ConnectionClosed(ctx context.Context)
+	HandshakeFailure(ctx context.Context)
+	AuthenticationFailure(ctx context.Context)
+	RuleDenial(ctx context.Context)
+	DialDuration(ctx context.Context, d time.Duration)
+	Reply(ctx context.Context, code byte)
+	UploadPacket(ctx context.Context)
+	DownloadPacket(ctx context.Context)
+}
+
+// extendMetrics adapts a Metrics implementation to ExtendedMetrics,
+// the instrumentation points it does not implement are discarded.
+func extendMetrics(m Metrics) ExtendedMetrics {
+	if extended, ok := m.(ExtendedMetrics); ok {
+		return extended
+	}
+
+	return &legacyMetrics{Metrics: m}
+}
+
+type legacyMetrics struct {
+	Metrics
+	nopMetrics
+}
+
+func (m *legacyMetrics) UploadBytes(ctx context.Context, n int64) {
+	m.Metrics.UploadBytes(ctx, n)
+}
+
+func (m *legacyMetrics) DownloadBytes(ctx context.Context, n int64) {
+	m.Metrics.DownloadBytes(ctx, n)
+}
+
 type nopMetrics struct{}
 
-func (m *nopMetrics) UploadBytes(_ context.Context, _ int64)   {}
-func (m *nopMetrics) DownloadBytes(_ context.Context, _ int64) {}
+func (m *nopMetrics) UploadBytes(_ context.Context, _ int64)          {}
+func (m *nopMetrics) DownloadBytes(_ context.Context, _ int64)        {}
+func (m *nopMetrics) ConnectionOpened(_ context.Context)              {}
+func (m *nopMetrics) ConnectionClosed(_ context.Context)              {}
+func (m *nopMetrics) HandshakeFailure(_ context.Context)              {}
+func (m *nopMetrics) AuthenticationFailure(_ context.Context)         {}
+func (m *nopMetrics) RuleDenial(_ context.Context)                    {}
+func (m *nopMetrics) DialDuration(_ context.Context, _ time.Duration) {}
+func (m *nopMetrics) Reply(_ context.Context, _ byte)                 {}
+func (m *nopMetrics) UploadPacket(_ context.Context)                  {}
+func (m *nopMetrics) DownloadPacket(_ context.Context)                {}
@@ -1,81 +1,446 @@
 package socks5
 
 import (
+	"container/list"
 	"net"
 	"sync"
 	"time"
 )
 
+const (
+	// defaultNatTTL is the idle time after which a mapping expires,
+	// RFC 4787 REQ-5 recommends 5 minutes.
+	defaultNatTTL = 5 * time.Minute
+	// defaultNatTick is the resolution of the expiration timer wheel.
+	defaultNatTick = time.Second
+	// defaultNatMaxEntries is the maximum number of mappings of an association.
+	defaultNatMaxEntries = 1024
+	// defaultNatMaxGlobalEntries is the maximum number of mappings of the server.
+	defaultNatMaxGlobalEntries = 65536
+)
+
+// Reasons the mappings of the UDP associations are evicted.
+const (
+	NatEvictionExpired          = "expired"
+	NatEvictionAssociationLimit = "association_limit"
+	NatEvictionGlobalLimit      = "global_limit"
+)
+
+// natEntry maps a destination of a UDP association to the client that sent
+// datagrams to it, the mapping is kept until it is evicted or the association ends.
 type natEntry struct {
-	src       net.Addr
-	packet    *packet
+	client net.Addr
+	// address is the destination as requested by the client,
+	// the header of the replies from the destination carries it.
+	address   *address
 	timestamp time.Time
+	// promoted is the time the entry was last moved to
+	// the front of the lru of the pool.
+	promoted time.Time
+
+	key    string
+	host   string
+	table  *natTable
+	local  *list.Element
+	global *list.Element
+	// slot is the slot of the timer wheel the entry is in.
+	slot int
+}
+
+// natPool bounds the mappings of all the UDP associations. The least recently
+// used mapping is evicted when an association or the server reaches its limit,
+// and the idle mappings expire on a timer wheel shared by the associations.
+// The mutex of a table guards its mappings and is taken before the mutex of
+// the pool, which guards the lru and the timer wheel of the pool.
+type natPool struct {
+	mutex      sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	maxGlobal  int
+	// lru holds every mapping, the most recently used first. A used mapping
+	// is moved to its front at most once a tick, so that the datagrams of
+	// the associations rarely take the mutex of the pool.
+	lru     *list.List
+	wheel   *timerWheel
+	running bool
+	now     func() time.Time
+}
+
+func newNatPool(ttl, tick time.Duration, maxEntries, maxGlobal int) *natPool {
+	return &natPool{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		maxGlobal:  maxGlobal,
+		lru:        list.New(),
+		wheel:      newTimerWheel(tick, ttl),
+		now:        time.Now,
+	}
+}
+
+func (p *natPool) newTable() *natTable {
+	return &natTable{
+		pool:  p,
+		table: make(map[string]*natEntry),
+		lru:   list.New(),
+		hosts: make(map[string]int),
+	}
+}
+
+// expire advances the timer wheel by a tick. The mappings idle for the ttl are
+// evicted, the others are rescheduled. It reports false and stops the wheel
+// once no mapping is left.
+func (p *natPool) expire() bool {
+	p.mutex.Lock()
+	due := p.wheel.advance()
+	p.mutex.Unlock()
+
+	for entry := range due {
+		entry.table.expire(entry)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.lru.Len() == 0 {
+		p.running = false
+	}
+
+	return p.running
+}
+
+// oldest returns the least recently used mapping
+// while the pool is over its limit, or nil.
+func (p *natPool) oldest() *natEntry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.lru.Len() <= p.maxGlobal {
+		return nil
+	}
+
+	return p.lru.Back().Value.(*natEntry)
+}
+
+func (p *natPool) startLocked() {
+	if p.running {
+		return
+	}
+
+	p.running = true
+
+	go func() {
+		ticker := time.NewTicker(p.wheel.tick)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if !p.expire() {
+				return
+			}
+		}
+	}()
 }
 
+// timerWheel is a hashed timing wheel of the mapping expirations. An entry is
+// checked when its slot comes up, so using a mapping only updates its timestamp.
+type timerWheel struct {
+	tick  time.Duration
+	slots []map[*natEntry]struct{}
+	pos   int
+}
+
+func newTimerWheel(tick, span time.Duration) *timerWheel {
+	w := &timerWheel{
+		tick:  tick,
+		slots: make([]map[*natEntry]struct{}, int(span/tick)+2),
+	}
+
+	for i := range w.slots {
+		w.slots[i] = make(map[*natEntry]struct{})
+	}
+
+	return w
+}
+
+// schedule puts the entry in the slot that comes up after the delay, a delay
+// longer than the wheel puts it in the farthest slot to be rescheduled.
+func (w *timerWheel) schedule(entry *natEntry, after time.Duration) {
+	ticks := int((after + w.tick - 1) / w.tick)
+	ticks = max(1, min(ticks, len(w.slots)-1))
+
+	entry.slot = (w.pos + ticks) % len(w.slots)
+	w.slots[entry.slot][entry] = struct{}{}
+}
+
+func (w *timerWheel) unschedule(entry *natEntry) {
+	delete(w.slots[entry.slot], entry)
+}
+
+// advance moves to the next slot and returns its entries.
+func (w *timerWheel) advance() map[*natEntry]struct{} {
+	w.pos = (w.pos + 1) % len(w.slots)
+
+	due := w.slots[w.pos]
+	w.slots[w.pos] = make(map[*natEntry]struct{})
+
+	return due
+}
+
+// natTable holds the mappings of a UDP association,
+// its callbacks run without holding the mutexes.
 type natTable struct {
-	mutex sync.RWMutex
+	pool  *natPool
+	mutex sync.Mutex
 	table map[string]*natEntry
+	// lru holds the mappings, the most recently used first.
+	lru *list.List
+	// hosts counts the mappings of every destination host.
+	hosts map[string]int
+	// onChange receives the changes of the number of
+	// mappings and destination hosts, it can be nil.
+	onChange func(entries, hosts int)
+	// onEvict receives the reason a mapping is evicted, it can be nil.
+	onEvict func(reason string)
 }
 
-func newNatTable() *natTable {
-	return &natTable{table: make(map[string]*natEntry)}
-}
+// set maps the destination to the client, or refreshes the mapping.
+func (n *natTable) set(client, dst net.Addr, addr *address) {
+	key := dst.String()
+
+	p := n.pool
 
-func (n *natTable) set(src, dst net.Addr, packet *packet) {
 	n.mutex.Lock()
-	n.table[dst.String()] = &natEntry{
-		src:       src,
-		packet:    packet,
-		timestamp: time.Now(),
+
+	if entry, ok := n.table[key]; ok {
+		entry.client = client
+		entry.address = addr
+		n.touchLocked(entry)
+
+		n.mutex.Unlock()
+		return
+	}
+
+	var evicted *natRemoval
+
+	if len(n.table) >= p.maxEntries {
+		removal := n.removeLocked(n.lru.Back().Value.(*natEntry), NatEvictionAssociationLimit)
+		evicted = &removal
+	}
+
+	now := p.now()
+
+	entry := &natEntry{
+		client:    client,
+		address:   addr,
+		timestamp: now,
+		promoted:  now,
+		key:       key,
+		host:      hostOf(dst),
+		table:     n,
+	}
+
+	entry.local = n.lru.PushFront(entry)
+	n.table[key] = entry
+
+	added := 0
+
+	if n.hosts[entry.host]++; n.hosts[entry.host] == 1 {
+		added = 1
 	}
+
+	p.mutex.Lock()
+	entry.global = p.lru.PushFront(entry)
+	p.wheel.schedule(entry, p.ttl)
+	p.startLocked()
+	p.mutex.Unlock()
+
 	n.mutex.Unlock()
+
+	if evicted != nil {
+		n.removed(*evicted)
+	}
+
+	n.changed(1, added)
+
+	// The mapping of another association can be the least recently used one,
+	// it is evicted without holding the mutex of this table.
+	for oldest := p.oldest(); oldest != nil; oldest = p.oldest() {
+		oldest.table.remove(oldest, NatEvictionGlobalLimit)
+	}
+}
+
+// hasHost reports whether a destination on the host of the address is mapped.
+func (n *natTable) hasHost(addr net.Addr) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.hosts[hostOf(addr)] > 0
 }
 
-func (n *natTable) get(dst net.Addr) (net.Addr, *packet, bool) {
-	n.mutex.RLock()
-	defer n.mutex.RUnlock()
+// get returns the mapping of the destination and refreshes it.
+func (n *natTable) get(dst net.Addr) (net.Addr, *address, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 
-	val, ok := n.table[dst.String()]
+	entry, ok := n.table[dst.String()]
 	if !ok {
-		return nil, nil, ok
+		return nil, nil, false
 	}
 
-	return val.src, val.packet, ok
+	n.touchLocked(entry)
+
+	return entry.client, entry.address, true
 }
 
-func (n *natTable) delete(dst net.Addr) {
+func (n *natTable) touchLocked(entry *natEntry) {
+	p := n.pool
+
+	entry.timestamp = p.now()
+
+	n.lru.MoveToFront(entry.local)
+
+	if entry.timestamp.Sub(entry.promoted) < p.wheel.tick {
+		return
+	}
+
+	entry.promoted = entry.timestamp
+
+	p.mutex.Lock()
+	p.lru.MoveToFront(entry.global)
+	p.mutex.Unlock()
+}
+
+// natRemoval is a removed mapping, the callbacks
+// of the table receive it after the mutex is released.
+type natRemoval struct {
+	hostRemoved bool
+	reason      string
+}
+
+// remove evicts the mapping unless it is already removed.
+func (n *natTable) remove(entry *natEntry, reason string) {
 	n.mutex.Lock()
-	delete(n.table, dst.String())
+
+	if n.table[entry.key] != entry {
+		n.mutex.Unlock()
+		return
+	}
+
+	removal := n.removeLocked(entry, reason)
+
 	n.mutex.Unlock()
+
+	n.removed(removal)
 }
 
-func (n *natTable) cleanup(period, ttl time.Duration) func() {
-	if period <= 0 || ttl <= 0 {
-		return func() {}
+// expire evicts the mapping that is idle for the ttl, or reschedules it.
+func (n *natTable) expire(entry *natEntry) {
+	p := n.pool
+
+	n.mutex.Lock()
+
+	if n.table[entry.key] != entry {
+		n.mutex.Unlock()
+		return
 	}
 
-	ticker := time.NewTicker(period)
-	done := make(chan struct{})
+	idle := p.now().Sub(entry.timestamp)
+	if idle < p.ttl {
+		p.mutex.Lock()
+		p.wheel.schedule(entry, p.ttl-idle)
+		p.mutex.Unlock()
 
-	go func() {
-		for {
-			select {
-			case <-done:
-				ticker.Stop()
-				return
-			case <-ticker.C:
-				n.mutex.Lock()
-				for key, val := range n.table {
-					if time.Since(val.timestamp) >= ttl {
-						delete(n.table, key)
-					}
-				}
-				n.mutex.Unlock()
-			}
-		}
-	}()
+		n.mutex.Unlock()
+		return
+	}
+
+	removal := n.removeLocked(entry, NatEvictionExpired)
+
+	n.mutex.Unlock()
+
+	n.removed(removal)
+}
+
+// removeLocked removes the mapping, a mapping removed
+// with the association has no eviction reason.
+func (n *natTable) removeLocked(entry *natEntry, reason string) natRemoval {
+	delete(n.table, entry.key)
 
-	return func() {
-		close(done)
+	n.lru.Remove(entry.local)
+
+	p := n.pool
+
+	p.mutex.Lock()
+	p.lru.Remove(entry.global)
+	p.wheel.unschedule(entry)
+	p.mutex.Unlock()
+
+	removal := natRemoval{reason: reason}
+
+	if n.hosts[entry.host]--; n.hosts[entry.host] <= 0 {
+		delete(n.hosts, entry.host)
+		removal.hostRemoved = true
+	}
+
+	return removal
+}
+
+// removed runs the callbacks of a removed mapping.
+func (n *natTable) removed(removal natRemoval) {
+	hosts := 0
+	if removal.hostRemoved {
+		hosts = -1
+	}
+
+	n.changed(-1, hosts)
+
+	if removal.reason != "" && n.onEvict != nil {
+		n.onEvict(removal.reason)
+	}
+}
+
+func (n *natTable) changed(entries, hosts int) {
+	if n.onChange != nil {
+		n.onChange(entries, hosts)
+	}
+}
+
+func (n *natTable) len() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return len(n.table)
+}
+
+// hostsLen returns the number of mapped destination hosts.
+func (n *natTable) hostsLen() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return len(n.hosts)
+}
+
+// clear removes every mapping when the association ends.
+func (n *natTable) clear() {
+	n.mutex.Lock()
+
+	removals := make([]natRemoval, 0, len(n.table))
+
+	for _, entry := range n.table {
+		removals = append(removals, n.removeLocked(entry, ""))
+	}
+
+	n.mutex.Unlock()
+
+	for _, removal := range removals {
+		n.removed(removal)
 	}
 }
+
+func hostOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
@@ -0,0 +1,222 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestNatTable() *natTable {
+	return newNatPool(defaultNatTTL, defaultNatTick, defaultNatMaxEntries, defaultNatMaxGlobalEntries).newTable()
+}
+
+func TestNatTable(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	first := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	second := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443}
+
+	firstAddr, err := parseAddress("dns.example:53")
+	require.NoError(t, err)
+
+	secondAddr, err := parseAddress(second.String())
+	require.NoError(t, err)
+
+	n := newTestNatTable()
+	n.set(client, first, firstAddr)
+	n.set(client, second, secondAddr)
+
+	// Replies do not remove the mapping.
+	for range 3 {
+		src, addr, ok := n.get(first)
+		require.True(t, ok)
+		assert.Equal(t, client, src)
+		assert.Equal(t, "dns.example:53", addr.String())
+	}
+
+	_, addr, ok := n.get(second)
+	require.True(t, ok)
+	assert.Equal(t, second.String(), addr.String())
+
+	_, _, ok = n.get(&net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 53})
+	assert.False(t, ok)
+
+	assert.Equal(t, 2, n.len())
+
+	assert.True(t, n.hasHost(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5353}))
+	assert.False(t, n.hasHost(&net.UDPAddr{IP: net.ParseIP("192.0.2.3"), Port: 53}))
+}
+
+func TestNatTableCleanup(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	idle := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	active := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+
+	n := newNatPool(50*time.Millisecond, 10*time.Millisecond, defaultNatMaxEntries, defaultNatMaxGlobalEntries).newTable()
+	n.set(client, idle, nil)
+	n.set(client, active, nil)
+
+	// Traffic from the destination keeps its mapping alive.
+	for range 10 {
+		time.Sleep(10 * time.Millisecond)
+		n.get(active)
+	}
+
+	_, _, ok := n.get(idle)
+	assert.False(t, ok)
+	assert.False(t, n.hasHost(idle))
+
+	_, _, ok = n.get(active)
+	assert.True(t, ok)
+}
+
+func TestNatTableChanges(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	var entries, hosts int
+
+	n := newTestNatTable()
+	n.onChange = func(e, h int) {
+		entries += e
+		hosts += h
+	}
+
+	for _, dst := range []string{"192.0.2.1:53", "192.0.2.1:443", "192.0.2.2:53"} {
+		addr, err := net.ResolveUDPAddr("udp", dst)
+		require.NoError(t, err)
+
+		n.set(client, addr, nil)
+		n.set(client, addr, nil)
+	}
+
+	assert.Equal(t, 3, entries)
+	assert.Equal(t, 2, hosts)
+	assert.Equal(t, 2, n.hostsLen())
+
+	n.clear()
+
+	assert.Zero(t, entries)
+	assert.Zero(t, hosts)
+}
+
+func TestNatPoolLimits(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	dst := func(i int) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000 + i}
+	}
+
+	pool := newNatPool(defaultNatTTL, defaultNatTick, 2, 3)
+
+	var evictions []string
+
+	first := pool.newTable()
+	first.onEvict = func(reason string) {
+		evictions = append(evictions, "first "+reason)
+	}
+
+	second := pool.newTable()
+	second.onEvict = func(reason string) {
+		evictions = append(evictions, "second "+reason)
+	}
+
+	first.set(client, dst(1), nil)
+	first.set(client, dst(2), nil)
+
+	// The least recently used mapping of the association is evicted.
+	first.get(dst(1))
+	first.set(client, dst(3), nil)
+
+	_, _, ok := first.get(dst(2))
+	assert.False(t, ok)
+
+	// The least recently used mapping of the server is evicted.
+	second.set(client, dst(4), nil)
+	second.set(client, dst(5), nil)
+
+	_, _, ok = first.get(dst(1))
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{
+		"first " + NatEvictionAssociationLimit,
+		"first " + NatEvictionGlobalLimit,
+	}, evictions)
+	assert.Equal(t, 1, first.len())
+	assert.Equal(t, 2, second.len())
+
+	// The mappings removed with the association are not evicted.
+	second.clear()
+
+	assert.Len(t, evictions, 2)
+	assert.Equal(t, 1, pool.lru.Len())
+}
+
+func TestNatPoolExpire(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+	idle := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}
+	active := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}
+
+	now := time.Now()
+
+	// The ticks are driven by the test.
+	pool := newNatPool(3*time.Hour, time.Hour, defaultNatMaxEntries, defaultNatMaxGlobalEntries)
+	pool.now = func() time.Time { return now }
+
+	var evictions []string
+
+	n := pool.newTable()
+	n.onEvict = func(reason string) {
+		evictions = append(evictions, reason)
+	}
+
+	n.set(client, idle, nil)
+	n.set(client, active, nil)
+
+	for range 3 {
+		now = now.Add(time.Hour)
+		n.get(active)
+
+		assert.True(t, pool.expire())
+	}
+
+	_, _, ok := n.get(idle)
+	assert.False(t, ok)
+	assert.Equal(t, []string{NatEvictionExpired}, evictions)
+
+	// The wheel stops when the last mapping expires.
+	for range 4 {
+		now = now.Add(time.Hour)
+		pool.expire()
+	}
+
+	assert.Zero(t, n.len())
+	assert.False(t, pool.expire())
+}
+
+func TestNatTableCallbacksUnlocked(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}
+
+	pool := newNatPool(defaultNatTTL, defaultNatTick, defaultNatMaxEntries, 1)
+
+	first := pool.newTable()
+	second := pool.newTable()
+
+	var lens []int
+
+	// The callbacks can use the tables, the mutexes are released.
+	first.onChange = func(int, int) {
+		lens = append(lens, first.len()+second.len())
+	}
+	first.onEvict = func(string) {
+		first.hasHost(client)
+	}
+
+	first.set(client, &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}, nil)
+	second.set(client, &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 53}, nil)
+
+	assert.Equal(t, []int{1, 1}, lens)
+	assert.Zero(t, first.len())
+	assert.Equal(t, 1, second.len())
+}
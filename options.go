@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
@@ -16,8 +18,35 @@ const (
 
 type Command int
 
+func (c Command) String() string {
+	switch c {
+	case Connect:
+		return "connect"
+	case Bind:
+		return "bind"
+	case UDPAssociate:
+		return "udp_associate"
+	case Resolve:
+		return "resolve"
+	case ResolvePTR:
+		return "resolve_ptr"
+	case UDPOverTCP:
+		return "udp_over_tcp"
+	default:
+		return fmt.Sprintf("0x%02x", int(c))
+	}
+}
+
+func (c Command) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
 type Option func(*options)
 
+// Reloader returns a new credentials store and rules when the server is
+// reloaded, a nil store or nil rules keep the current ones.
+type Reloader func(ctx context.Context) (Store, Rules, error)
+
 type options struct {
 	host                   string
 	port                   int
@@ -35,11 +64,38 @@ type options struct {
 	packetWriteTimeout     time.Duration
 	ttlPacket              time.Duration
 	natCleanupPeriod       time.Duration
+	natMaxEntries          int
+	natMaxGlobalEntries    int
+	dnsInterception        bool
+	dnsSinkholeIPv4        net.IP
+	dnsSinkholeIPv6        net.IP
+	dnsLocalAnswers        bool
+	sniffTimeout           time.Duration
 	logger                 Logger
 	store                  Store
 	driver                 Driver
+	resolver               Resolver
+	dialPreference         IPPreference
+	dialAttemptDelay       time.Duration
+	sourceSelector         SourceSelector
 	metrics                Metrics
 	rules                  Rules
+	tracer                 Tracer
+	accessLogger           AccessLogger
+	reloader               Reloader
+	hooks                  Hooks
+	commandHandlers        map[Command]Handler
+	resolveCommands        bool
+	udpOverTCP             bool
+	adminAddress           string
+	adminToken             string
+	adminTLSConfig         *tls.Config
+	echoConnectReply       bool
+	udpFiltering           UDPFiltering
+	udpMTU                 int
+	udpRelayPorts          []int
+	udpPacketRate          int
+	udpByteRate            int
 }
 
 func (o options) authMethods() map[byte]struct{} {
@@ -68,6 +124,22 @@ func optsWithDefaults(opts *options) *options {
 		opts.maxPacketSize = 1500
 	}
 
+	if opts.ttlPacket <= 0 {
+		opts.ttlPacket = defaultNatTTL
+	}
+
+	if opts.natCleanupPeriod <= 0 {
+		opts.natCleanupPeriod = defaultNatTick
+	}
+
+	if opts.natMaxEntries <= 0 {
+		opts.natMaxEntries = defaultNatMaxEntries
+	}
+
+	if opts.natMaxGlobalEntries <= 0 {
+		opts.natMaxGlobalEntries = defaultNatMaxGlobalEntries
+	}
+
 	if opts.publicIP == nil {
 		opts.publicIP = net.ParseIP("127.0.0.1")
 	}
@@ -90,9 +162,21 @@ func optsWithDefaults(opts *options) *options {
 		}
 	}
 
+	if opts.dialAttemptDelay <= 0 {
+		opts.dialAttemptDelay = defaultDialAttemptDelay
+	}
+
+	if opts.resolver == nil {
+		opts.resolver = &systemResolver{}
+	}
+
 	if opts.driver == nil {
 		opts.driver = &netDriver{
-			timeout: opts.dialTimeout,
+			timeout:      opts.dialTimeout,
+			attemptDelay: opts.dialAttemptDelay,
+			preference:   opts.dialPreference,
+			resolver:     opts.resolver,
+			selector:     opts.sourceSelector,
 		}
 	}
 
@@ -100,9 +184,21 @@ func optsWithDefaults(opts *options) *options {
 		opts.metrics = &nopMetrics{}
 	}
 
+	if opts.tracer == nil {
+		opts.tracer = &nopTracer{}
+	}
+
+	if opts.accessLogger == nil {
+		opts.accessLogger = &nopAccessLogger{}
+	}
+
 	if opts.rules == nil {
 		if opts.allowCommands == nil {
 			opts.allowCommands = permitAllCommands()
+
+			for cmd := range opts.commandHandlers {
+				opts.allowCommands[byte(cmd)] = struct{}{}
+			}
 		}
 
 		opts.rules = &serverRules{
@@ -156,6 +252,33 @@ func WithDialTimeout(val time.Duration) Option {
 	}
 }
 
+// WithDialPreference sets the address family the default Driver tries first
+// when a destination has both IPv4 and IPv6 addresses, IPv6 by default as
+// recommended by RFC 8305. OnlyIPv4 and OnlyIPv6 skip the other family.
+// The UDP destinations are sent to the first address, IPv4 by default.
+func WithDialPreference(val IPPreference) Option {
+	return func(o *options) {
+		o.dialPreference = val
+	}
+}
+
+// WithDialAttemptDelay sets how long the default Driver waits for a connection
+// attempt before racing it with an attempt to the next address, 250ms by default.
+func WithDialAttemptDelay(val time.Duration) Option {
+	return func(o *options) {
+		o.dialAttemptDelay = val
+	}
+}
+
+// WithSourceSelector sets how the default Driver picks the local address of the
+// outbound connections and of the relayed UDP datagrams on a multi-homed host, see
+// FixedSource, InterfaceSource, RoundRobinSource, RandomSource and StickySource.
+func WithSourceSelector(val SourceSelector) Option {
+	return func(o *options) {
+		o.sourceSelector = val
+	}
+}
+
 func WithGetPasswordTimeout(val time.Duration) Option {
 	return func(o *options) {
 		o.getPasswordTimeout = val
@@ -192,6 +315,17 @@ func WithDriver(val Driver) Option {
 	}
 }
 
+// WithResolver sets the resolver used by the default Driver to dial CONNECT
+// destinations and to resolve UDP destinations, see NewCachingResolver.
+// It has no effect with a custom Driver.
+func WithResolver(val Resolver) Option {
+	return func(o *options) {
+		o.resolver = val
+	}
+}
+
+// WithMetrics sets the metrics collector. Implement ExtendedMetrics to
+// receive connection, authentication, rule, dial and reply events as well.
 func WithMetrics(val Metrics) Option {
 	return func(o *options) {
 		o.metrics = val
@@ -204,6 +338,25 @@ func WithRules(val Rules) Option {
 	}
 }
 
+// WithTracer sets the tracer that creates a span per session with child spans
+// for authentication, rule evaluation, dialing, resolving and relaying.
+// Use NewTracer to export the spans to a SpanExporter.
+func WithTracer(val Tracer) Option {
+	return func(o *options) {
+		o.tracer = val
+	}
+}
+
+// WithAccessLogger sets the hook that receives a record of every finished
+// request, see NewJSONAccessLogger and NewSquidAccessLogger.
+func WithAccessLogger(val AccessLogger) Option {
+	return func(o *options) {
+		o.accessLogger = val
+	}
+}
+
+// WithAllowCommands restricts the requests to the commands, the extension
+// commands and the commands of WithCommandHandler included.
 func WithAllowCommands(commands ...Command) Option {
 	allowCommands := map[byte]struct{}{}
 
@@ -249,8 +402,8 @@ func WithMaxPacketSize(val int) Option {
 }
 
 // WithTTLPacket sets how long the packet will stay in the table
-// that links the sender of the packet to the remote host it was meant for.
-// Nat cleanup period must be greater than 0.
+// that links the sender of the packet to the remote host it was meant for,
+// 5 minutes by default.
 func WithTTLPacket(val time.Duration) Option {
 	return func(o *options) {
 		o.ttlPacket = val
@@ -258,11 +411,191 @@ func WithTTLPacket(val time.Duration) Option {
 }
 
 // WithNatCleanupPeriod sets the period when the table that links the
-// packets from the sender to the remote host will be cleaned.
-// It makes sense if there's no time limit on the TCP connection.
-// TTL of the packet must be greater than 0.
+// packets from the sender to the remote host will be cleaned, 1 second
+// by default. The expired packets are removed within the period.
 func WithNatCleanupPeriod(val time.Duration) Option {
 	return func(o *options) {
 		o.natCleanupPeriod = val
 	}
 }
+
+// WithUDPNatLimits sets the maximum number of destinations linked to the
+// clients in the table of a UDP association and of the server, 1024 and 65536
+// by default. The least recently used destination is removed at the limit.
+func WithUDPNatLimits(perAssociation, global int) Option {
+	return func(o *options) {
+		o.natMaxEntries = perAssociation
+		o.natMaxGlobalEntries = global
+	}
+}
+
+// WithEchoConnectReply restores the legacy CONNECT reply that echoes the
+// requested destination in BND.ADDR and BND.PORT instead of the local
+// address of the outbound connection required by RFC 1928.
+func WithEchoConnectReply() Option {
+	return func(o *options) {
+		o.echoConnectReply = true
+	}
+}
+
+// WithUDPFiltering sets which remote hosts can send datagrams to the client
+// of a UDP association, AddressAndPortDependentFiltering by default. The rules
+// are applied to the source of every datagram forwarded to the client.
+func WithUDPFiltering(val UDPFiltering) Option {
+	return func(o *options) {
+		o.udpFiltering = val
+	}
+}
+
+// WithUDPFragmentation enables the fragmentation of UDP datagrams, RFC 1928
+// section 7. The fragments sent by a client are reassembled before they are
+// forwarded, and the replies larger than the client MTU are fragmented.
+// Without it the fragments are dropped.
+func WithUDPFragmentation(clientMTU int) Option {
+	return func(o *options) {
+		o.udpMTU = clientMTU
+	}
+}
+
+// WithUDPRelayPorts makes the UDP associations share the relay sockets on the
+// ports instead of listening on a socket each, the clients send datagrams to
+// one of the ports, while the datagrams to the remote hosts are sent from a
+// socket of every association. Every client address is bound to one
+// association. A port waits for the first datagram of a single association
+// per client host, the UDP ASSOCIATE requests of a host that has one waiting
+// on every port, like the clients behind a NAT, are refused.
+func WithUDPRelayPorts(ports ...int) Option {
+	return func(o *options) {
+		o.udpRelayPorts = ports
+	}
+}
+
+// WithUDPRateLimit caps the datagrams a client sends through a UDP association
+// to packetsPerSecond datagrams and bytesPerSecond bytes, a zero rate is not
+// limited. The datagrams over the limit are dropped, and a datagram larger
+// than bytesPerSecond is always dropped.
+func WithUDPRateLimit(packetsPerSecond, bytesPerSecond int) Option {
+	return func(o *options) {
+		o.udpPacketRate = packetsPerSecond
+		o.udpByteRate = bytesPerSecond
+	}
+}
+
+// WithDNSInterception parses the DNS queries that the UDP associations relay
+// to port 53 and applies the destination rules to the queried names, so the
+// clients cannot bypass the blocked hosts with their own resolver. The queries
+// for a blocked name are answered with NXDOMAIN.
+func WithDNSInterception() Option {
+	return func(o *options) {
+		o.dnsInterception = true
+	}
+}
+
+// WithDNSSinkhole answers the intercepted A and AAAA queries for a blocked name
+// with the sinkhole address of their family instead of NXDOMAIN, a nil address
+// keeps NXDOMAIN. It enables WithDNSInterception.
+func WithDNSSinkhole(ipv4, ipv6 net.IP) Option {
+	return func(o *options) {
+		o.dnsInterception = true
+		o.dnsSinkholeIPv4 = ipv4
+		o.dnsSinkholeIPv6 = ipv6
+	}
+}
+
+// WithDNSLocalAnswers answers the intercepted A and AAAA queries with the
+// Resolver of the server instead of relaying them, the other queries are
+// relayed. A UDP association has at most 16 queries resolved at once, the
+// next ones are dropped. It enables WithDNSInterception.
+func WithDNSLocalAnswers() Option {
+	return func(o *options) {
+		o.dnsInterception = true
+		o.dnsLocalAnswers = true
+	}
+}
+
+// WithSniffing peeks at the first bytes of the CONNECT streams to IP
+// destinations for the TLS server name or the HTTP Host, and applies the rules
+// to the sniffed name. The Driver can route the dial by SniffedHostFromContext.
+// The success reply is sent before the destination is dialed, so a failed dial
+// closes the connection, the reply code of the dial is recorded in the metrics
+// and the access log. The peek waits up to the timeout, 300 milliseconds by
+// default, for the client to send its first bytes. A ClientHello is sniffed
+// across TLS records up to the 4096 bytes of the read buffer, the rules are
+// not applied to the name of a larger one.
+func WithSniffing(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout <= 0 {
+			timeout = defaultSniffTimeout
+		}
+
+		o.sniffTimeout = timeout
+	}
+}
+
+// WithHooks sets the callbacks invoked at the lifecycle stages of a session.
+func WithHooks(val Hooks) Option {
+	return func(o *options) {
+		o.hooks = val
+	}
+}
+
+// WithCommandHandler registers the handler of a command that the server does not
+// implement, such as a vendor extension. The handler runs behind the middleware.
+func WithCommandHandler(cmd Command, handler Handler) Option {
+	return func(o *options) {
+		if o.commandHandlers == nil {
+			o.commandHandlers = make(map[Command]Handler)
+		}
+
+		o.commandHandlers[cmd] = handler
+	}
+}
+
+// WithResolveCommands enables the Tor RESOLVE and RESOLVE_PTR extension commands,
+// the names are resolved by the Driver so that clients do not leak DNS queries.
+func WithResolveCommands() Option {
+	return func(o *options) {
+		o.resolveCommands = true
+	}
+}
+
+// WithUDPOverTCP enables the UDPOverTCP extension command, the datagrams of
+// the clients behind firewalls that drop UDP are carried over the control
+// connection. The UDP ASSOCIATE rules apply to it.
+func WithUDPOverTCP() Option {
+	return func(o *options) {
+		o.udpOverTCP = true
+	}
+}
+
+// WithReloader sets the function that provides fresh credentials and rules
+// when Server.Reload is called, for example from the admin API.
+func WithReloader(val Reloader) Option {
+	return func(o *options) {
+		o.reloader = val
+	}
+}
+
+// WithAdminAddress enables the admin HTTP API on a separate listener
+// opened through the Driver. The API is protected by a bearer token
+// or client certificates, see WithAdminToken and WithAdminTLSConfig.
+func WithAdminAddress(val string) Option {
+	return func(o *options) {
+		o.adminAddress = val
+	}
+}
+
+// WithAdminToken sets the bearer token required by the admin API.
+func WithAdminToken(val string) Option {
+	return func(o *options) {
+		o.adminToken = val
+	}
+}
+
+// WithAdminTLSConfig serves the admin API over TLS. Requests with a verified
+// client certificate are authorized, set ClientAuth and ClientCAs for mTLS.
+func WithAdminTLSConfig(val *tls.Config) Option {
+	return func(o *options) {
+		o.adminTLSConfig = val
+	}
+}
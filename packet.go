@@ -8,16 +8,14 @@ import (
 
 type payload []byte
 
-func (p *payload) reset() {
-	*p = nil
-}
-
 func (p payload) len() int64 {
 	return int64(len(p))
 }
 
 type packet struct {
 	address *address
+	// frag is the fragment number, zero for a standalone datagram.
+	frag    byte
 	payload payload
 }
 
@@ -35,11 +33,6 @@ func (p *packet) decode(data []byte) error {
 		return errors.New("failed to read current fragment number")
 	}
 
-	// If not support fragmentation must drop any datagram whose FRAG field is other than 0x00
-	if frag != 0x00 {
-		return errors.New("not support fragmentation")
-	}
-
 	var address address
 
 	address.Type, err = buffer.ReadByte()
@@ -79,6 +72,7 @@ func (p *packet) decode(data []byte) error {
 	}
 
 	p.address = &address
+	p.frag = frag
 	p.payload = buffer.Bytes()
 
 	return nil
@@ -86,9 +80,9 @@ func (p *packet) decode(data []byte) error {
 
 func (p *packet) encode(data []byte) {
 	p.payload = []byte{
-		0x00, // Reserved byte
-		0x00, // Reserved byte
-		0x00, // Current fragment number
+		0x00,   // Reserved byte
+		0x00,   // Reserved byte
+		p.frag, // Current fragment number
 		p.address.Type,
 	}
 
@@ -0,0 +1,296 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// Default buckets of the dial duration histogram, in seconds.
+var dialDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics collects the server metrics in memory and exposes them
+// in the Prometheus text exposition format. It is also an http.Handler that
+// can be mounted on the /metrics path of a web server.
+type PrometheusMetrics struct {
+	mutex    sync.Mutex
+	families map[string]*metricFamily
+	dial     *histogram
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		families: make(map[string]*metricFamily),
+		dial: &histogram{
+			name:    "socks5_dial_duration_seconds",
+			help:    "Time spent dialing the destination of a CONNECT request.",
+			buckets: dialDurationBuckets,
+			counts:  make([]uint64, len(dialDurationBuckets)),
+		},
+	}
+
+	m.register("socks5_upload_bytes_total", "Bytes sent from clients to destinations.", counterType, "command", "user")
+	m.register("socks5_download_bytes_total", "Bytes sent from destinations to clients.", counterType, "command", "user")
+	m.register("socks5_connections_total", "Accepted client connections.", counterType)
+	m.register("socks5_active_connections", "Client connections currently being served.", gaugeType)
+	m.register("socks5_handshake_failures_total", "Failed method negotiations.", counterType)
+	m.register("socks5_auth_failures_total", "Failed username/password authentications.", counterType)
+	m.register("socks5_rule_denials_total", "Connections, requests and datagrams denied by the rules.", counterType, "command", "user")
+	m.register("socks5_replies_total", "Replies sent to clients.", counterType, "command", "reply", "user")
+	m.register("socks5_udp_packets_total", "Relayed UDP datagrams.", counterType, "direction", "user")
+	m.register("socks5_udp_drops_total", "Dropped UDP datagrams.", counterType, "reason", "user")
+	m.register("socks5_udp_nat_entries", "Mappings of the active UDP associations.", gaugeType)
+	m.register("socks5_udp_destinations", "Destination hosts of the active UDP associations.", gaugeType)
+	m.register("socks5_udp_nat_evictions_total", "Evicted mappings of the UDP associations.", counterType, "reason")
+
+	return m
+}
+
+func (m *PrometheusMetrics) UploadBytes(ctx context.Context, n int64) {
+	m.add("socks5_upload_bytes_total", float64(n), commandLabel(ctx), userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) DownloadBytes(ctx context.Context, n int64) {
+	m.add("socks5_download_bytes_total", float64(n), commandLabel(ctx), userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) ConnectionOpened(_ context.Context) {
+	m.add("socks5_connections_total", 1)
+	m.add("socks5_active_connections", 1)
+}
+
+func (m *PrometheusMetrics) ConnectionClosed(_ context.Context) {
+	m.add("socks5_active_connections", -1)
+}
+
+func (m *PrometheusMetrics) HandshakeFailure(_ context.Context) {
+	m.add("socks5_handshake_failures_total", 1)
+}
+
+// AuthenticationFailure is not labeled by the user, the username of a failed
+// authentication is chosen by the client and would add a series on every try.
+func (m *PrometheusMetrics) AuthenticationFailure(_ context.Context) {
+	m.add("socks5_auth_failures_total", 1)
+}
+
+func (m *PrometheusMetrics) RuleDenial(ctx context.Context) {
+	m.add("socks5_rule_denials_total", 1, commandLabel(ctx), userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) DialDuration(_ context.Context, d time.Duration) {
+	m.mutex.Lock()
+	m.dial.observe(d.Seconds())
+	m.mutex.Unlock()
+}
+
+func (m *PrometheusMetrics) Reply(ctx context.Context, code byte) {
+	m.add("socks5_replies_total", 1, commandLabel(ctx), replyName(code), userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) UploadPacket(ctx context.Context) {
+	m.add("socks5_udp_packets_total", 1, "upload", userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) DownloadPacket(ctx context.Context) {
+	m.add("socks5_udp_packets_total", 1, "download", userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) UDPDrop(ctx context.Context, reason string) {
+	m.add("socks5_udp_drops_total", 1, reason, userLabel(ctx))
+}
+
+func (m *PrometheusMetrics) UDPNatEntries(_ context.Context, delta int) {
+	m.add("socks5_udp_nat_entries", float64(delta))
+}
+
+func (m *PrometheusMetrics) UDPDestinations(_ context.Context, delta int) {
+	m.add("socks5_udp_destinations", float64(delta))
+}
+
+func (m *PrometheusMetrics) UDPNatEviction(_ context.Context, reason string) {
+	m.add("socks5_udp_nat_evictions_total", 1, reason)
+}
+
+// ServeHTTP writes the collected metrics in the text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.WriteTo(w)
+}
+
+// WriteTo writes the collected metrics in the text exposition format to w.
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	var buff bytes.Buffer
+
+	m.mutex.Lock()
+
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		m.families[name].write(&buff)
+	}
+
+	m.dial.write(&buff)
+
+	m.mutex.Unlock()
+
+	return buff.WriteTo(w)
+}
+
+func (m *PrometheusMetrics) register(name, help, kind string, labels ...string) {
+	m.families[name] = &metricFamily{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+}
+
+func (m *PrometheusMetrics) add(name string, v float64, labelValues ...string) {
+	m.mutex.Lock()
+	m.families[name].add(v, labelValues)
+	m.mutex.Unlock()
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+type metricFamily struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	values map[string]*sample
+}
+
+func (f *metricFamily) add(v float64, labelValues []string) {
+	key := strings.Join(labelValues, "\xff")
+
+	s, ok := f.values[key]
+	if !ok {
+		s = &sample{labelValues: labelValues}
+		f.values[key] = s
+	}
+
+	s.value += v
+}
+
+func (f *metricFamily) write(w *bytes.Buffer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	if len(f.values) == 0 && len(f.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", f.name)
+		return
+	}
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.values[key]
+
+		w.WriteString(f.name)
+		writeLabels(w, f.labels, s.labelValues)
+		fmt.Fprintf(w, " %s\n", formatFloat(s.value))
+	}
+}
+
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w *bytes.Buffer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", h.name, histogramType)
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeLabels(w *bytes.Buffer, names, values []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	w.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+
+		fmt.Fprintf(w, "%s=\"%s\"", name, escapeLabelValue(values[i]))
+	}
+
+	w.WriteByte('}')
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func commandLabel(ctx context.Context) string {
+	if command, ok := CommandFromContext(ctx); ok {
+		return command.String()
+	}
+
+	return ""
+}
+
+func userLabel(ctx context.Context) string {
+	username, _ := UsernameFromContext(ctx)
+	return username
+}
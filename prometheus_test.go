@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	metrics := NewPrometheusMetrics()
+
+	ctx := contextWithCommand(contextWithUsername(context.Background(), `ro"ot`), connect)
+
+	metrics.ConnectionOpened(ctx)
+	metrics.ConnectionOpened(ctx)
+	metrics.ConnectionClosed(ctx)
+	metrics.UploadBytes(ctx, 512)
+	metrics.UploadBytes(ctx, 512)
+	metrics.Reply(ctx, connectionSuccessful)
+	metrics.Reply(ctx, hostUnreachable)
+	metrics.RuleDenial(ctx)
+	metrics.AuthenticationFailure(ctx)
+	metrics.AuthenticationFailure(contextWithUsername(ctx, "guess"))
+	metrics.DialDuration(ctx, 20*time.Millisecond)
+	metrics.UploadPacket(contextWithCommand(ctx, udpAssociate))
+	metrics.UDPDrop(ctx, UDPDropRateLimit)
+	metrics.UDPNatEntries(ctx, 2)
+	metrics.UDPNatEntries(ctx, -1)
+	metrics.UDPDestinations(ctx, 1)
+	metrics.UDPNatEviction(ctx, NatEvictionExpired)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	body := recorder.Body.String()
+
+	for _, line := range []string{
+		"# TYPE socks5_active_connections gauge",
+		"socks5_active_connections 1",
+		"socks5_connections_total 2",
+		"socks5_handshake_failures_total 0",
+		"socks5_auth_failures_total 2",
+		`socks5_upload_bytes_total{command="connect",user="ro\"ot"} 1024`,
+		`socks5_replies_total{command="connect",reply="succeeded",user="ro\"ot"} 1`,
+		`socks5_replies_total{command="connect",reply="host_unreachable",user="ro\"ot"} 1`,
+		`socks5_rule_denials_total{command="connect",user="ro\"ot"} 1`,
+		`socks5_udp_packets_total{direction="upload",user="ro\"ot"} 1`,
+		`socks5_udp_drops_total{reason="rate_limit",user="ro\"ot"} 1`,
+		"socks5_udp_nat_entries 1",
+		"socks5_udp_destinations 1",
+		`socks5_udp_nat_evictions_total{reason="expired"} 1`,
+		`socks5_dial_duration_seconds_bucket{le="0.01"} 0`,
+		`socks5_dial_duration_seconds_bucket{le="0.025"} 1`,
+		`socks5_dial_duration_seconds_count 1`,
+	} {
+		assert.Contains(t, body, line+"\n")
+	}
+}
+
+func TestExtendMetrics(t *testing.T) {
+	legacy := &countingMetrics{}
+
+	metrics := extendMetrics(legacy)
+	metrics.UploadBytes(context.Background(), 10)
+	metrics.DownloadBytes(context.Background(), 5)
+	metrics.Reply(context.Background(), connectionSuccessful)
+
+	assert.Equal(t, int64(15), legacy.total)
+
+	prometheus := NewPrometheusMetrics()
+	assert.Same(t, prometheus, extendMetrics(prometheus))
+}
+
+func TestUDPNatMetrics(t *testing.T) {
+	// A UDPMetrics implemented before the evictions are reported keeps its statistics.
+	udp := &udpCountingMetrics{}
+
+	assert.Same(t, udp, udpMetrics(udp))
+	assert.IsType(t, &nopMetrics{}, udpNatMetrics(udp))
+
+	prometheus := NewPrometheusMetrics()
+	assert.Same(t, prometheus, udpNatMetrics(prometheus))
+}
+
+type udpCountingMetrics struct {
+	countingMetrics
+}
+
+func (m *udpCountingMetrics) UDPDrop(_ context.Context, _ string)      {}
+func (m *udpCountingMetrics) UDPNatEntries(_ context.Context, _ int)   {}
+func (m *udpCountingMetrics) UDPDestinations(_ context.Context, _ int) {}
+
+type countingMetrics struct {
+	total int64
+}
+
+func (m *countingMetrics) UploadBytes(_ context.Context, n int64)   { m.total += n }
+func (m *countingMetrics) DownloadBytes(_ context.Context, n int64) { m.total += n }
@@ -1,13 +1,31 @@
 package socks5
 
-import "io"
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	// relayBufferSize is the size of the buffers used to copy a stream
+	// when the zero-copy path is not available.
+	relayBufferSize = 32 * 1024
+
+	// spliceChunkSize limits a single splice so that the byte counter
+	// of the session is updated while the stream is live, the counter
+	// lags behind the stream by less than a chunk.
+	spliceChunkSize = 64 * 1024
+)
 
 type closeWriter interface {
 	CloseWrite() error
 }
 
-func relay(dst io.Writer, src io.Reader) (int64, error) {
-	n, err := io.Copy(dst, src)
+// relay copies src to dst, the copied bytes are added to counter as they are written.
+func relay(dst io.Writer, src io.Reader, pool *bytePool, counter *atomic.Int64) (int64, error) {
+	dst = unwrapConnection(dst)
+
+	n, err := copyStream(dst, src, pool, counter)
 
 	if writer, ok := dst.(closeWriter); ok {
 		// Send EOF for next io.Copy
@@ -16,3 +34,80 @@ func relay(dst io.Writer, src io.Reader) (int64, error) {
 
 	return n, err
 }
+
+func copyStream(dst io.Writer, src io.Reader, pool *bytePool, counter *atomic.Int64) (int64, error) {
+	var written int64
+
+	if conn, ok := src.(*connection); ok {
+		// Bytes already read ahead by the handshake must be sent
+		// before the raw connection can be used directly.
+		n, err := conn.flushBuffered(dst)
+		counter.Add(n)
+		if err != nil {
+			return n, err
+		}
+
+		written, src = n, conn.Conn
+	}
+
+	if canSplice(dst, src) {
+		n, err := spliceStream(dst.(io.ReaderFrom), src, counter)
+		return written + n, err
+	}
+
+	buff := pool.get()
+	defer pool.put(buff)
+
+	// Hide ReaderFrom and WriterTo so that io.CopyBuffer uses the pooled buffer.
+	n, err := io.CopyBuffer(&countingWriter{Writer: dst, counter: counter}, readerOnly{src}, buff)
+
+	return written + n, err
+}
+
+func spliceStream(dst io.ReaderFrom, src io.Reader, counter *atomic.Int64) (int64, error) {
+	var written int64
+
+	// A limited reader over a TCP connection is still spliced.
+	limited := &io.LimitedReader{R: src}
+
+	for {
+		limited.N = spliceChunkSize
+
+		n, err := dst.ReadFrom(limited)
+		counter.Add(n)
+		written += n
+
+		if err != nil || n < spliceChunkSize {
+			return written, err
+		}
+	}
+}
+
+func unwrapConnection(w io.Writer) io.Writer {
+	if conn, ok := w.(*connection); ok {
+		return conn.Conn
+	}
+
+	return w
+}
+
+func isTCPConn(v any) bool {
+	_, ok := v.(*net.TCPConn)
+	return ok
+}
+
+type countingWriter struct {
+	io.Writer
+	counter *atomic.Int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.counter.Add(int64(n))
+
+	return n, err
+}
+
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,9 @@
+package socks5
+
+import "io"
+
+// canSplice reports whether the stream can be copied in the kernel
+// with splice(2), which net.TCPConn.ReadFrom uses for TCP sources.
+func canSplice(dst io.Writer, src io.Reader) bool {
+	return isTCPConn(dst) && isTCPConn(src)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package socks5
+
+import "io"
+
+func canSplice(_ io.Writer, _ io.Reader) bool {
+	return false
+}
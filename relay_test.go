@@ -0,0 +1,127 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const benchmarkChunkSize = 128 * 1024
+
+func TestRelayFlushesBufferedBytes(t *testing.T) {
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	target, sink := tcpPipe(t)
+	defer target.Close()
+	defer sink.Close()
+
+	_, err := client.Write([]byte{0x05, 0x01, 'h', 'e', 'l', 'l', 'o'})
+	require.NoError(t, err)
+	require.NoError(t, client.(*net.TCPConn).CloseWrite())
+
+	conn := newConnection(server)
+
+	header := make([]byte, 2)
+	_, err = io.ReadFull(conn.reader, header)
+	require.NoError(t, err)
+
+	var counter atomic.Int64
+
+	n, err := relay(target, conn, newBytePool(relayBufferSize), &counter)
+	require.NoError(t, err)
+
+	body, err := io.ReadAll(sink)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(5), n)
+	assert.Equal(t, int64(5), counter.Load())
+	assert.Equal(t, []byte("hello"), body)
+}
+
+func BenchmarkRelay(b *testing.B) {
+	pool := newBytePool(relayBufferSize)
+
+	var counter atomic.Int64
+
+	benchmarkRelay(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		return relay(dst, src, pool, &counter)
+	})
+}
+
+// BenchmarkRelayLegacy measures the io.Copy on the connection wrapper
+// that was used before the relay learned to splice and pool buffers.
+func BenchmarkRelayLegacy(b *testing.B) {
+	benchmarkRelay(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		n, err := io.Copy(dst, src)
+
+		if writer, ok := dst.(closeWriter); ok {
+			writer.CloseWrite()
+		}
+
+		return n, err
+	})
+}
+
+func benchmarkRelay(b *testing.B, relayFn func(dst io.Writer, src io.Reader) (int64, error)) {
+	chunk := make([]byte, benchmarkChunkSize)
+
+	b.ReportAllocs()
+	b.SetBytes(benchmarkChunkSize)
+
+	for b.Loop() {
+		b.StopTimer()
+
+		client, server := tcpPipe(b)
+		target, sink := tcpPipe(b)
+
+		done := make(chan struct{})
+
+		go func() {
+			io.Copy(io.Discard, sink)
+			close(done)
+		}()
+
+		b.StartTimer()
+
+		go func() {
+			client.Write(chunk)
+			client.Close()
+		}()
+
+		if _, err := relayFn(target, newConnection(server)); err != nil {
+			b.Fatal(err)
+		}
+
+		<-done
+
+		b.StopTimer()
+
+		server.Close()
+		target.Close()
+		sink.Close()
+
+		b.StartTimer()
+	}
+}
+
+func tcpPipe(tb testing.TB) (net.Conn, net.Conn) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(tb, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(tb, err)
+
+	server, err := l.Accept()
+	require.NoError(tb, err)
+
+	return client, server
+}
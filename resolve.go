@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Tor extension commands, see the socks-extensions.txt of the Tor project.
+const (
+	// Resolve asks the server to resolve the requested domain name, the
+	// reply carries the IP address in BND.ADDR.
+	Resolve Command = 0xF0
+	// ResolvePTR asks the server for the name of the requested IP address,
+	// the reply carries the domain name in BND.ADDR.
+	ResolvePTR Command = 0xF1
+)
+
+var errReverseLookupNotSupported = errors.New("reverse lookup is not supported")
+
+// ReverseResolver is an optional interface of Driver used by RESOLVE_PTR,
+// the default Driver uses it on its Resolver.
+type ReverseResolver interface {
+	LookupAddr(ctx context.Context, ip net.IP) ([]string, error)
+}
+
+// resolveHandler serves the RESOLVE command with the Driver.
+func (s *Server) resolveHandler(ctx context.Context, req *Request, w ReplyWriter) {
+	resolved, err := s.resolveDestination(ctx, "tcp", req.Destination)
+	if err != nil {
+		sessionFromContext(ctx).close(CloseReasonDialError)
+
+		s.logger.Error(ctx, "failed to resolve destination", LogKeyError, err)
+
+		w.Reply(replyCodeFromError(err), "")
+		return
+	}
+
+	host, _, err := net.SplitHostPort(resolved.String())
+	if err != nil {
+		w.Reply(ReplyGeneralFailure, "")
+		return
+	}
+
+	sessionFromContext(ctx).close(CloseReasonCompleted)
+
+	w.Reply(ReplySucceeded, net.JoinHostPort(host, "0"))
+}
+
+// resolvePTRHandler serves the RESOLVE_PTR command with the Driver.
+func (s *Server) resolvePTRHandler(ctx context.Context, req *Request, w ReplyWriter) {
+	host, _, err := net.SplitHostPort(req.Destination)
+	if err != nil {
+		w.Reply(ReplyGeneralFailure, "")
+		return
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		sessionFromContext(ctx).close(CloseReasonNotSupported)
+
+		w.Reply(ReplyAddressTypeNotSupported, "")
+		return
+	}
+
+	resolver, ok := s.driver.(ReverseResolver)
+	if !ok {
+		sessionFromContext(ctx).close(CloseReasonNotSupported)
+
+		s.logger.Error(ctx, "failed to resolve address", LogKeyError, errReverseLookupNotSupported)
+
+		w.Reply(ReplyCommandNotSupported, "")
+		return
+	}
+
+	names, err := resolver.LookupAddr(ctx, ip)
+	if errors.Is(err, errReverseLookupNotSupported) {
+		sessionFromContext(ctx).close(CloseReasonNotSupported)
+
+		s.logger.Error(ctx, "failed to resolve address", LogKeyError, err)
+
+		w.Reply(ReplyCommandNotSupported, "")
+		return
+	}
+
+	if err == nil && len(names) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	if err != nil {
+		sessionFromContext(ctx).close(CloseReasonDialError)
+
+		s.logger.Error(ctx, "failed to resolve address", LogKeyError, err)
+
+		w.Reply(replyCodeFromError(err), "")
+		return
+	}
+
+	sessionFromContext(ctx).close(CloseReasonCompleted)
+
+	w.Reply(ReplySucceeded, net.JoinHostPort(strings.TrimSuffix(names[0], "."), "0"))
+}
@@ -0,0 +1,489 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultResolverTimeout    = 5 * time.Second
+	defaultResolverMaxTTL     = time.Hour
+	defaultResolverNegTTL     = 30 * time.Second
+	defaultResolverSystemTTL  = 30 * time.Second
+	defaultResolverMaxEntries = 4096
+)
+
+// Preferences of the address family of the resolved addresses.
+const (
+	PreferNone IPPreference = iota
+	PreferIPv4
+	PreferIPv6
+	OnlyIPv4
+	OnlyIPv6
+)
+
+var (
+	errNoUpstreamAnswer   = errors.New("no upstream dns server answered")
+	errSharedBootstrapIPs = errors.New("bootstrap ips are shared by several dns upstreams given by name")
+)
+
+// IPPreference orders or filters the addresses returned by the resolver.
+type IPPreference int
+
+// Resolver resolves host names for the default Driver, it is used
+// to dial CONNECT destinations and to resolve UDP destinations.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+type systemResolver struct{}
+
+func (r *systemResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, network, host)
+}
+
+type ResolverOption func(*CachingResolver) error
+
+// CachingResolver is a Resolver with a TTL-aware positive and negative cache.
+// It queries the configured upstream DNS servers, or the system resolver
+// when there are none, and answers the static hosts without a query.
+type CachingResolver struct {
+	servers     []resolverUpstream
+	upstreams   []dnsTransport
+	bootstrap   []net.IP
+	tlsConfig   *tls.Config
+	hosts       map[string][]net.IP
+	preference  IPPreference
+	timeout     time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	mutex       sync.Mutex
+	cache       map[string]*resolverEntry
+	group       singleflight.Group
+	now         func() time.Time
+}
+
+// resolverUpstream is a DNS server with the bootstrap IPs of its name.
+type resolverUpstream struct {
+	server    string
+	bootstrap []net.IP
+}
+
+type resolverEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+func NewCachingResolver(opts ...ResolverOption) (*CachingResolver, error) {
+	r := &CachingResolver{
+		hosts:       make(map[string][]net.IP),
+		timeout:     defaultResolverTimeout,
+		maxTTL:      defaultResolverMaxTTL,
+		negativeTTL: defaultResolverNegTTL,
+		maxEntries:  defaultResolverMaxEntries,
+		cache:       make(map[string]*resolverEntry),
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	var shared int
+
+	for _, upstream := range r.servers {
+		bootstrap := upstream.bootstrap
+
+		if len(bootstrap) == 0 {
+			bootstrap = r.bootstrap
+
+			if len(bootstrap) > 0 && upstreamName(upstream.server) != "" {
+				shared++
+			}
+		}
+
+		transport, err := parseUpstream(upstream.server, r.tlsConfig, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+
+		r.upstreams = append(r.upstreams, transport)
+	}
+
+	// The servers of different names do not listen on the same IPs.
+	if shared > 1 {
+		return nil, errSharedBootstrapIPs
+	}
+
+	return r, nil
+}
+
+// WithResolverUpstreams sets the DNS servers queried in order, as
+// "udp://host:port", "tcp://host:port" or "host[:port]" for UDP,
+// "tls://host:port" for DNS-over-TLS, RFC 7858, and the URL of
+// a DNS-over-HTTPS endpoint such as "https://host/dns-query", RFC 8484.
+func WithResolverUpstreams(servers ...string) ResolverOption {
+	return func(r *CachingResolver) error {
+		for _, server := range servers {
+			r.servers = append(r.servers, resolverUpstream{server: server})
+		}
+
+		return nil
+	}
+}
+
+// WithResolverUpstream adds a DNS server queried after the previous ones, in
+// the forms of WithResolverUpstreams, with the addresses used to connect to
+// a DNS-over-TLS or DNS-over-HTTPS server given by name, so that the name is
+// not resolved by the system resolver. The name is still used to verify the
+// certificate.
+func WithResolverUpstream(server string, bootstrap ...net.IP) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.servers = append(r.servers, resolverUpstream{server: server, bootstrap: bootstrap})
+		return nil
+	}
+}
+
+// WithResolverBootstrapIPs sets the addresses used to connect to the DNS-over-TLS
+// or DNS-over-HTTPS server given by name, so that the name is not resolved
+// by the system resolver. The name is still used to verify the certificate.
+// NewCachingResolver fails when several servers given by name would share
+// the addresses, WithResolverUpstream sets them for every server.
+func WithResolverBootstrapIPs(ips ...net.IP) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.bootstrap = ips
+		return nil
+	}
+}
+
+// WithResolverTLSConfig sets the TLS config of the DNS-over-TLS
+// and DNS-over-HTTPS connections, for example to trust a private CA.
+func WithResolverTLSConfig(val *tls.Config) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.tlsConfig = val
+		return nil
+	}
+}
+
+// WithResolverHosts sets static host overrides in the manner of /etc/hosts.
+func WithResolverHosts(hosts map[string][]net.IP) ResolverOption {
+	return func(r *CachingResolver) error {
+		for host, ips := range hosts {
+			r.hosts[normalizeHost(host)] = ips
+		}
+
+		return nil
+	}
+}
+
+// WithResolverPreference sets the preferred address family.
+func WithResolverPreference(val IPPreference) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.preference = val
+		return nil
+	}
+}
+
+// WithResolverTimeout sets the timeout of a query to an upstream server.
+func WithResolverTimeout(val time.Duration) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.timeout = val
+		return nil
+	}
+}
+
+// WithResolverMaxTTL caps how long an answer is cached.
+func WithResolverMaxTTL(val time.Duration) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.maxTTL = val
+		return nil
+	}
+}
+
+// WithResolverNegativeTTL sets how long a missing name is cached
+// when the answer carries no SOA record.
+func WithResolverNegativeTTL(val time.Duration) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.negativeTTL = val
+		return nil
+	}
+}
+
+// WithResolverMaxEntries bounds the number of cached answers.
+func WithResolverMaxEntries(val int) ResolverOption {
+	return func(r *CachingResolver) error {
+		r.maxEntries = val
+		return nil
+	}
+}
+
+func (r *CachingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return r.order(network, []net.IP{ip}, host)
+	}
+
+	name := normalizeHost(host)
+
+	if ips, ok := r.hosts[name]; ok {
+		return r.order(network, ips, host)
+	}
+
+	var (
+		ips      []net.IP
+		firstErr error
+	)
+
+	for _, qtype := range r.queryTypes(network) {
+		answer, err := r.lookup(ctx, name, qtype)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		ips = append(ips, answer...)
+	}
+
+	if len(ips) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+
+	return r.order(network, ips, host)
+}
+
+// LookupAddr returns the names of the IP address from the upstream servers,
+// or from the system resolver when there are none. The answers are not cached.
+func (r *CachingResolver) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if len(r.upstreams) == 0 {
+		return net.DefaultResolver.LookupAddr(ctx, ip.String())
+	}
+
+	name := reverseName(ip)
+
+	query, id, err := newDNSQuery(name, dnsmessage.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	lastErr := errNoUpstreamAnswer
+
+	for _, upstream := range r.upstreams {
+		response, err := upstream.exchange(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		names, err := parsePTRAnswer(response, id, name)
+		if err != nil && !isNotFoundError(err) {
+			lastErr = err
+			continue
+		}
+
+		return names, err
+	}
+
+	return nil, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+func (r *CachingResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, error) {
+	key := name + "/" + qtype.String()
+
+	if entry, ok := r.cached(key); ok {
+		return entry.ips, entry.err
+	}
+
+	// The query is shared by the concurrent lookups of the name, it is not
+	// canceled with the lookup that started it and is bounded by the timeout.
+	results := r.group.DoChan(key, func() (any, error) {
+		ips, ttl, err := r.query(context.WithoutCancel(ctx), name, qtype)
+		if err != nil && !isNotFoundError(err) {
+			return nil, err
+		}
+
+		entry := &resolverEntry{
+			ips:     ips,
+			err:     err,
+			expires: r.now().Add(min(ttl, r.maxTTL)),
+		}
+
+		r.store(key, entry)
+
+		return entry, nil
+	})
+
+	var result singleflight.Result
+
+	select {
+	case result = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	entry := result.Val.(*resolverEntry)
+
+	return entry.ips, entry.err
+}
+
+func (r *CachingResolver) cached(key string) (*resolverEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+
+	if !r.now().Before(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+
+	return entry, true
+}
+
+func (r *CachingResolver) store(key string, entry *resolverEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.cache) >= r.maxEntries {
+		now := r.now()
+
+		for k, e := range r.cache {
+			if !now.Before(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+
+		// Still full: drop an arbitrary entry.
+		for k := range r.cache {
+			if len(r.cache) < r.maxEntries {
+				break
+			}
+
+			delete(r.cache, k)
+		}
+	}
+
+	r.cache[key] = entry
+}
+
+// query asks the upstream servers, or the system resolver when there are none,
+// and returns the addresses with the time they may be cached.
+func (r *CachingResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if len(r.upstreams) == 0 {
+		network := "ip4"
+		if qtype == dnsmessage.TypeAAAA {
+			network = "ip6"
+		}
+
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, r.negativeTTL, err
+		}
+
+		return ips, defaultResolverSystemTTL, nil
+	}
+
+	query, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lastErr := errNoUpstreamAnswer
+
+	for _, upstream := range r.upstreams {
+		response, err := upstream.exchange(ctx, query)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		ips, ttl, err := parseDNSAnswer(response, id, name, qtype, r.negativeTTL)
+		if err != nil && !isNotFoundError(err) {
+			lastErr = err
+			continue
+		}
+
+		return ips, ttl, err
+	}
+
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+func (r *CachingResolver) queryTypes(network string) []dnsmessage.Type {
+	switch {
+	case network == "ip4" || r.preference == OnlyIPv4:
+		return []dnsmessage.Type{dnsmessage.TypeA}
+	case network == "ip6" || r.preference == OnlyIPv6:
+		return []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	}
+}
+
+// order filters the addresses by network and preference and sorts the preferred family first.
+func (r *CachingResolver) order(network string, ips []net.IP, host string) ([]net.IP, error) {
+	result := make([]net.IP, 0, len(ips))
+
+	for _, ip := range ips {
+		isIPv4 := ip.To4() != nil
+
+		if (network == "ip4" || r.preference == OnlyIPv4) && !isIPv4 {
+			continue
+		}
+
+		if (network == "ip6" || r.preference == OnlyIPv6) && isIPv4 {
+			continue
+		}
+
+		result = append(result, ip)
+	}
+
+	if len(result) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	switch r.preference {
+	case PreferIPv4:
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].To4() != nil && result[j].To4() == nil
+		})
+	case PreferIPv6:
+		sort.SliceStable(result, func(i, j int) bool {
+			return result[i].To4() == nil && result[j].To4() != nil
+		})
+	}
+
+	return result, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func isNotFoundError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
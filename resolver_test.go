@@ -0,0 +1,583 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type dnsStubRecord struct {
+	a    []net.IP
+	aaaa []net.IP
+	ptr  []string
+	ttl  uint32
+}
+
+// dnsStub is an in-process DNS server answering over UDP and TCP on the same port.
+type dnsStub struct {
+	mutex    sync.Mutex
+	records  map[string]dnsStubRecord
+	truncate bool
+	// delay holds the answers over UDP back.
+	delay   time.Duration
+	queries atomic.Int64
+	conns   atomic.Int64
+	address string
+}
+
+func newDNSStub(t *testing.T, records map[string]dnsStubRecord) *dnsStub {
+	t.Helper()
+
+	stub := &dnsStub{records: records}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	stub.address = pc.LocalAddr().String()
+
+	l, err := net.Listen("tcp", stub.address)
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		pc.Close()
+		l.Close()
+	})
+
+	go stub.servePacket(pc)
+	go stub.serveStream(l)
+
+	return stub
+}
+
+func (s *dnsStub) setTruncate(val bool) {
+	s.mutex.Lock()
+	s.truncate = val
+	s.mutex.Unlock()
+}
+
+func (s *dnsStub) setDelay(val time.Duration) {
+	s.mutex.Lock()
+	s.delay = val
+	s.mutex.Unlock()
+}
+
+func (s *dnsStub) servePacket(pc net.PacketConn) {
+	buf := make([]byte, 512)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		s.mutex.Lock()
+		truncate, delay := s.truncate, s.delay
+		s.mutex.Unlock()
+
+		time.Sleep(delay)
+
+		response, err := s.answer(buf[:n], truncate)
+		if err != nil {
+			continue
+		}
+
+		pc.WriteTo(response, addr)
+	}
+}
+
+func (s *dnsStub) serveStream(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.conns.Add(1)
+
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers the length-prefixed queries of a connection until it is closed.
+func (s *dnsStub) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+
+		query := make([]byte, int(length[0])<<8|int(length[1]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		response, err := s.answer(query, false)
+		if err != nil {
+			return
+		}
+
+		conn.Write(append([]byte{byte(len(response) >> 8), byte(len(response))}, response...))
+	}
+}
+
+func (s *dnsStub) answer(query []byte, truncate bool) ([]byte, error) {
+	s.queries.Add(1)
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+
+	question := msg.Questions[0]
+
+	msg.Header.Response = true
+	msg.Header.Truncated = truncate
+
+	if truncate {
+		return msg.Pack()
+	}
+
+	record, ok := s.records[question.Name.String()]
+	if !ok {
+		msg.Header.RCode = dnsmessage.RCodeNameError
+		msg.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("test."),
+				Type:  dnsmessage.TypeSOA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.test."),
+				MBox:   dnsmessage.MustNewName("admin.test."),
+				MinTTL: 10,
+			},
+		}}
+
+		return msg.Pack()
+	}
+
+	for _, ip := range record.a {
+		if question.Type != dnsmessage.TypeA {
+			break
+		}
+
+		var body dnsmessage.AResource
+		copy(body.A[:], ip.To4())
+
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: record.ttl},
+			Body:   &body,
+		})
+	}
+
+	for _, ip := range record.aaaa {
+		if question.Type != dnsmessage.TypeAAAA {
+			break
+		}
+
+		var body dnsmessage.AAAAResource
+		copy(body.AAAA[:], ip.To16())
+
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: record.ttl},
+			Body:   &body,
+		})
+	}
+
+	for _, name := range record.ptr {
+		if question.Type != dnsmessage.TypePTR {
+			break
+		}
+
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: record.ttl},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(name)},
+		})
+	}
+
+	return msg.Pack()
+}
+
+func testRecords() map[string]dnsStubRecord {
+	return map[string]dnsStubRecord{
+		"dual.test.": {
+			a:    []net.IP{net.ParseIP("192.0.2.1")},
+			aaaa: []net.IP{net.ParseIP("2001:db8::1")},
+			ttl:  300,
+		},
+		"short.test.": {
+			a:   []net.IP{net.ParseIP("192.0.2.2")},
+			ttl: 1,
+		},
+	}
+}
+
+func TestCachingResolverCache(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+
+	r, err := NewCachingResolver(WithResolverUpstreams(stub.address))
+	require.NoError(t, err)
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+
+	ips, err := r.LookupIP(ctx, "ip", "dual.test")
+	require.NoError(t, err)
+	assert.Len(t, ips, 2)
+	assert.Equal(t, int64(2), stub.queries.Load())
+
+	_, err = r.LookupIP(ctx, "ip", "DUAL.test.")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stub.queries.Load(), "answer is cached")
+
+	_, err = r.LookupIP(ctx, "ip4", "short.test")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stub.queries.Load())
+
+	now = now.Add(2 * time.Second)
+
+	_, err = r.LookupIP(ctx, "ip4", "short.test")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stub.queries.Load(), "answer expired with its TTL")
+}
+
+func TestCachingResolverNegativeCache(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+
+	r, err := NewCachingResolver(WithResolverUpstreams("udp://" + stub.address))
+	require.NoError(t, err)
+
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	ctx := context.Background()
+
+	_, err = r.LookupIP(ctx, "ip4", "missing.test")
+	assert.True(t, isNotFoundError(err))
+	assert.True(t, isNoSuchHostError(err))
+
+	_, err = r.LookupIP(ctx, "ip4", "missing.test")
+	assert.True(t, isNotFoundError(err))
+	assert.Equal(t, int64(1), stub.queries.Load(), "missing name is cached")
+
+	// The SOA minimum TTL of ten seconds bounds the negative answer.
+	now = now.Add(11 * time.Second)
+
+	_, err = r.LookupIP(ctx, "ip4", "missing.test")
+	assert.True(t, isNotFoundError(err))
+	assert.Equal(t, int64(2), stub.queries.Load())
+
+	// A name without AAAA records resolves to its A records only.
+	ips, err := r.LookupIP(ctx, "ip", "short.test")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("192.0.2.2").To4()}, ips)
+}
+
+func TestCachingResolverHostsAndPreference(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+
+	cases := map[string]struct {
+		preference IPPreference
+		network    string
+		host       string
+		want       []string
+		notFound   bool
+	}{
+		"static_host": {
+			host: "static.test",
+			want: []string{"10.0.0.1"},
+		},
+		"prefer_none": {
+			host: "dual.test",
+			want: []string{"192.0.2.1", "2001:db8::1"},
+		},
+		"prefer_ipv6": {
+			preference: PreferIPv6,
+			host:       "dual.test",
+			want:       []string{"2001:db8::1", "192.0.2.1"},
+		},
+		"only_ipv4": {
+			preference: OnlyIPv4,
+			host:       "dual.test",
+			want:       []string{"192.0.2.1"},
+		},
+		"ip6_network": {
+			network: "ip6",
+			host:    "dual.test",
+			want:    []string{"2001:db8::1"},
+		},
+		"only_ipv6_without_records": {
+			preference: OnlyIPv6,
+			host:       "short.test",
+			notFound:   true,
+		},
+		"ip_literal": {
+			host: "192.0.2.9",
+			want: []string{"192.0.2.9"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r, err := NewCachingResolver(
+				WithResolverUpstreams(stub.address),
+				WithResolverPreference(tc.preference),
+				WithResolverHosts(map[string][]net.IP{
+					"Static.Test": {net.ParseIP("10.0.0.1")},
+				}),
+			)
+			require.NoError(t, err)
+
+			network := tc.network
+			if network == "" {
+				network = "ip"
+			}
+
+			ips, err := r.LookupIP(context.Background(), network, tc.host)
+			if tc.notFound {
+				assert.True(t, isNotFoundError(err))
+				return
+			}
+
+			require.NoError(t, err)
+
+			got := make([]string, 0, len(ips))
+			for _, ip := range ips {
+				got = append(got, ip.String())
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestCachingResolverTCPFallback(t *testing.T) {
+	stub := newDNSStub(t, testRecords())
+	stub.setTruncate(true)
+
+	r, err := NewCachingResolver(WithResolverUpstreams(stub.address))
+	require.NoError(t, err)
+
+	ips, err := r.LookupIP(context.Background(), "ip4", "dual.test")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ips[0].String())
+	assert.Equal(t, int64(2), stub.queries.Load(), "truncated answer is retried over tcp")
+
+	r, err = NewCachingResolver(WithResolverUpstreams("tcp://" + stub.address))
+	require.NoError(t, err)
+
+	_, err = r.LookupIP(context.Background(), "ip4", "dual.test")
+	require.NoError(t, err)
+}
+
+func TestCachingResolverUpstreamFailure(t *testing.T) {
+	_, err := NewCachingResolver(WithResolverUpstreams("quic://127.0.0.1"))
+	assert.Error(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+
+	r, err := NewCachingResolver(
+		WithResolverUpstreams(pc.LocalAddr().String()),
+		WithResolverTimeout(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+
+	_, err = r.LookupIP(context.Background(), "ip4", "dual.test")
+
+	var dnsErr *net.DNSError
+	require.True(t, errors.As(err, &dnsErr))
+	assert.True(t, dnsErr.IsTemporary)
+	assert.False(t, dnsErr.IsNotFound)
+}
+
+func TestCachingResolverSharedQueryCanceled(t *testing.T) {
+	stub := newDNSStub(t, map[string]dnsStubRecord{
+		"slow.test.": {
+			a:   []net.IP{net.ParseIP("192.0.2.1")},
+			ttl: 300,
+		},
+	})
+	// The truncated answer is retried over TCP after the first lookup is canceled.
+	stub.setDelay(100 * time.Millisecond)
+	stub.setTruncate(true)
+
+	r, err := NewCachingResolver(WithResolverUpstreams(stub.address))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	canceled := make(chan error, 1)
+
+	go func() {
+		_, err := r.LookupIP(ctx, "ip4", "slow.test")
+		canceled <- err
+	}()
+
+	// The second lookup waits for the query of the first one.
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	ips, err := r.LookupIP(context.Background(), "ip4", "slow.test")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ips[0].String())
+
+	assert.ErrorIs(t, <-canceled, context.Canceled)
+
+	// The answer of the shared query is cached.
+	_, err = r.LookupIP(context.Background(), "ip4", "slow.test")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stub.queries.Load())
+}
+
+func TestNetDriverResolver(t *testing.T) {
+	stub := newDNSStub(t, map[string]dnsStubRecord{
+		"local.test.": {
+			a:   []net.IP{net.ParseIP("127.0.0.1")},
+			ttl: 300,
+		},
+	})
+
+	r, err := NewCachingResolver(WithResolverUpstreams(stub.address))
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := &netDriver{timeout: time.Second, resolver: r}
+
+	conn, err := d.Dial("tcp", net.JoinHostPort("local.test", port))
+	require.NoError(t, err)
+	conn.Close()
+
+	addr, err := d.Resolve("udp", "local.test:53")
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:53", addr.String())
+
+	_, err = d.Dial("tcp", "missing.test:80")
+	assert.True(t, isNoSuchHostError(err))
+
+	// A and AAAA queries for each name, the second lookup of local.test is cached.
+	assert.Equal(t, int64(4), stub.queries.Load())
+}
+
+func TestNetDriverResolve(t *testing.T) {
+	dual := staticResolver{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}
+
+	testCases := map[string]struct {
+		resolver   Resolver
+		preference IPPreference
+		address    string
+		notFound   bool
+	}{
+		"ipv4_first_by_default": {
+			resolver: dual,
+			address:  "192.0.2.1:53",
+		},
+		"preference": {
+			resolver:   dual,
+			preference: PreferIPv6,
+			address:    "[2001:db8::1]:53",
+		},
+		"no_address_of_the_family": {
+			resolver:   staticResolver{net.ParseIP("2001:db8::1")},
+			preference: OnlyIPv4,
+			notFound:   true,
+		},
+		"empty_answer": {
+			resolver: staticResolver{},
+			notFound: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := &netDriver{resolver: tc.resolver, preference: tc.preference}
+
+			addr, err := d.Resolve("udp", "dual.test:53")
+			if tc.notFound {
+				assert.True(t, isNotFoundError(err))
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.address, addr.String())
+		})
+	}
+}
+
+// staticResolver answers every name with its addresses.
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(_ context.Context, _, _ string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestCachingResolverLookupAddr(t *testing.T) {
+	stub := newDNSStub(t, map[string]dnsStubRecord{
+		"1.2.0.192.in-addr.arpa.": {
+			ptr: []string{"host.test."},
+			ttl: 300,
+		},
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.": {
+			ptr: []string{"host6.test."},
+			ttl: 300,
+		},
+	})
+
+	r, err := NewCachingResolver(WithResolverUpstreams(stub.address))
+	require.NoError(t, err)
+
+	names, err := r.LookupAddr(context.Background(), net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.test."}, names)
+
+	names, err = r.LookupAddr(context.Background(), net.ParseIP("2001:db8::1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host6.test."}, names)
+
+	_, err = r.LookupAddr(context.Background(), net.ParseIP("192.0.2.2"))
+	assert.True(t, isNotFoundError(err))
+
+	// The default Driver asks its resolver, a resolver without reverse
+	// lookups does not fall back to the system resolver.
+	d := &netDriver{resolver: r}
+
+	names, err = d.LookupAddr(context.Background(), net.ParseIP("192.0.2.1"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.test."}, names)
+
+	d = &netDriver{resolver: testLookupIPResolver{}}
+
+	_, err = d.LookupAddr(context.Background(), net.ParseIP("192.0.2.1"))
+	assert.ErrorIs(t, err, errReverseLookupNotSupported)
+}
+
+// testLookupIPResolver is a Resolver without reverse lookups.
+type testLookupIPResolver struct{}
+
+func (testLookupIPResolver) LookupIP(_ context.Context, _, _ string) ([]net.IP, error) {
+	return nil, errors.New("not implemented")
+}
@@ -11,6 +11,12 @@ type Rules interface {
 	IsAllowDestination(ctx context.Context, host string) bool
 }
 
+// RuleCounter is an optional interface of Rules that reports the
+// number of configured rules by kind, it is shown by the admin API.
+type RuleCounter interface {
+	RuleCounts() map[string]int
+}
+
 type serverRules struct {
 	allowCommands  map[byte]struct{}
 	blockListHosts map[string]struct{}
@@ -50,10 +56,21 @@ func (r *serverRules) IsAllowDestination(ctx context.Context, host string) bool
 	return !ok
 }
 
+func (r *serverRules) RuleCounts() map[string]int {
+	return map[string]int{
+		"allow_commands":   len(r.allowCommands),
+		"block_list_hosts": len(r.blockListHosts),
+		"allow_ips":        len(r.allowIPs),
+	}
+}
+
 func permitAllCommands() map[byte]struct{} {
 	return map[byte]struct{}{
-		connect:      {},
-		bind:         {},
-		udpAssociate: {},
+		connect:          {},
+		bind:             {},
+		udpAssociate:     {},
+		byte(Resolve):    {},
+		byte(ResolvePTR): {},
+		byte(UDPOverTCP): {},
 	}
 }
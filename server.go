@@ -2,7 +2,10 @@ package socks5
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,19 +20,54 @@ type config struct {
 	packetWriteTimeout time.Duration
 	ttlPacket          time.Duration
 	natCleanupPeriod   time.Duration
+	adminAddress       string
+	adminToken         string
+	adminTLSConfig     *tls.Config
+	echoConnectReply   bool
+	udpFiltering       UDPFiltering
+	udpMTU             int
+	udpRelayPorts      []int
+	udpPacketRate      int
+	udpByteRate        int
+	dnsInterception    bool
+	dnsSinkholeIPv4    net.IP
+	dnsSinkholeIPv6    net.IP
+	dnsLocalAnswers    bool
+	sniffTimeout       time.Duration
+}
+
+// policy is the credentials store and the rules,
+// they are replaced together when the server is reloaded.
+type policy struct {
+	store Store
+	rules Rules
 }
 
 type Server struct {
-	config        *config
-	logger        Logger
-	store         Store
-	driver        Driver
-	metrics       Metrics
-	rules         Rules
-	bytePool      *bytePool
-	active        chan struct{}
-	done          chan struct{}
-	closeListener func() error
+	config          *config
+	logger          Logger
+	driver          Driver
+	resolver        Resolver
+	metrics         ExtendedMetrics
+	udpMetrics      UDPMetrics
+	natMetrics      UDPNatMetrics
+	nat             *natPool
+	policy          atomic.Pointer[policy]
+	reloader        Reloader
+	tracer          Tracer
+	accessLogger    AccessLogger
+	hooks           *hooks
+	handler         Handler
+	middleware      []Middleware
+	commandHandlers map[Command]Handler
+	sessions        *sessionRegistry
+	bytePool        *bytePool
+	relayPool       *bytePool
+	active          chan struct{}
+	done            chan struct{}
+	closeListener   func() error
+	adminServer     *http.Server
+	udpRelay        *udpRelay
 }
 
 func New(opts ...Option) *Server {
@@ -41,7 +79,7 @@ func New(opts ...Option) *Server {
 
 	options = optsWithDefaults(options)
 
-	return &Server{
+	srv := &Server{
 		config: &config{
 			host:               options.host,
 			address:            options.listenAddress(),
@@ -53,16 +91,63 @@ func New(opts ...Option) *Server {
 			packetWriteTimeout: options.packetWriteTimeout,
 			ttlPacket:          options.ttlPacket,
 			natCleanupPeriod:   options.natCleanupPeriod,
+			adminAddress:       options.adminAddress,
+			adminToken:         options.adminToken,
+			adminTLSConfig:     options.adminTLSConfig,
+			echoConnectReply:   options.echoConnectReply,
+			udpFiltering:       options.udpFiltering,
+			udpMTU:             options.udpMTU,
+			udpRelayPorts:      options.udpRelayPorts,
+			udpPacketRate:      options.udpPacketRate,
+			udpByteRate:        options.udpByteRate,
+			dnsInterception:    options.dnsInterception,
+			dnsSinkholeIPv4:    options.dnsSinkholeIPv4,
+			dnsSinkholeIPv6:    options.dnsSinkholeIPv6,
+			dnsLocalAnswers:    options.dnsLocalAnswers,
+			sniffTimeout:       options.sniffTimeout,
 		},
-		logger:   options.logger,
-		store:    options.store,
-		driver:   options.driver,
-		metrics:  options.metrics,
-		rules:    options.rules,
-		bytePool: newBytePool(options.maxPacketSize),
-		active:   make(chan struct{}),
-		done:     make(chan struct{}),
+		logger:     options.logger,
+		driver:     options.driver,
+		resolver:   options.resolver,
+		metrics:    extendMetrics(options.metrics),
+		udpMetrics: udpMetrics(options.metrics),
+		natMetrics: udpNatMetrics(options.metrics),
+		nat: newNatPool(options.ttlPacket, options.natCleanupPeriod,
+			options.natMaxEntries, options.natMaxGlobalEntries),
+		reloader:     options.reloader,
+		tracer:       options.tracer,
+		accessLogger: options.accessLogger,
+		hooks:        newHooks(options.hooks, options.logger),
+		sessions:     newSessionRegistry(),
+		bytePool:     newBytePool(options.maxPacketSize),
+		relayPool:    newBytePool(relayBufferSize),
+		active:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	srv.handler = HandlerFunc(srv.serveRequest)
+
+	srv.commandHandlers = make(map[Command]Handler)
+
+	if options.resolveCommands {
+		srv.commandHandlers[Resolve] = HandlerFunc(srv.resolveHandler)
+		srv.commandHandlers[ResolvePTR] = HandlerFunc(srv.resolvePTRHandler)
+	}
+
+	if options.udpOverTCP {
+		srv.commandHandlers[UDPOverTCP] = HandlerFunc(srv.udpOverTCPHandler)
+	}
+
+	for cmd, handler := range options.commandHandlers {
+		srv.commandHandlers[cmd] = handler
 	}
+
+	srv.policy.Store(&policy{
+		store: options.store,
+		rules: options.rules,
+	})
+
+	return srv
 }
 
 func (s *Server) ListenAndServe() error {
@@ -75,13 +160,32 @@ func (s *Server) ListenAndServe() error {
 
 	ctx := context.Background()
 
+	if s.config.adminAddress != "" {
+		if err := s.listenAndServeAdmin(ctx); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	if len(s.config.udpRelayPorts) > 0 {
+		if s.udpRelay, err = s.listenUDPRelay(ctx); err != nil {
+			l.Close()
+
+			if s.adminServer != nil {
+				s.adminServer.Close()
+			}
+
+			return err
+		}
+	}
+
 	s.logger.Info(ctx, "server starting...")
 
 	for s.isActive() {
 		conn, err := l.Accept()
 		if err != nil {
 			if !isClosedListenerError(err) {
-				s.logger.Error(ctx, "failed to accept connection: "+err.Error())
+				s.logger.Error(ctx, "failed to accept connection", LogKeyError, err)
 			}
 
 			continue
@@ -106,6 +210,14 @@ func (s *Server) Shutdown() error {
 
 	err := s.closeListener()
 
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+
+	if s.udpRelay != nil {
+		s.udpRelay.close()
+	}
+
 	<-s.done
 
 	return err
@@ -116,16 +228,53 @@ func (s *Server) serve(conn net.Conn) {
 
 	remoteAddr := conn.RemoteAddr()
 
-	if !s.rules.IsAllowConnection(remoteAddr) {
+	sess := newSession(remoteAddr)
+	sess.onTerminate(conn)
+
+	ctx := contextWithRemoteAddress(context.Background(), remoteAddr)
+	ctx = contextWithSessionID(ctx, sess.id)
+	ctx = contextWithSession(ctx, sess)
+
+	if !s.policy.Load().rules.IsAllowConnection(remoteAddr) {
+		s.metrics.RuleDenial(ctx)
 		return
 	}
 
-	conn.SetReadDeadline(newDeadline(s.config.readTimeout))
-	conn.SetWriteDeadline(newDeadline(s.config.writeTimeout))
+	s.metrics.ConnectionOpened(ctx)
+	defer s.metrics.ConnectionClosed(ctx)
 
-	ctx := contextWithRemoteAddress(context.Background(), remoteAddr)
+	s.sessions.add(sess)
+	defer s.sessions.delete(sess.id)
+
+	s.hooks.onAccept(ctx, remoteAddr)
+	defer s.finishSession(ctx, sess)
+
+	ctx, span := s.tracer.Start(ctx, SpanSession)
+	defer span.End()
+
+	span.SetAttributes(
+		Attribute{Key: AttributeSessionID, Value: sess.id},
+		Attribute{Key: AttributeClient, Value: remoteAddr.String()},
+	)
+
+	ctx = contextWithSessionSpan(ctx, span)
+
+	// The greeting and the authentication that fail are logged as well.
+	defer s.logAccess(ctx, sess)
+
+	client := newConnection(conn)
+	client.SetReadDeadline(newDeadline(s.config.readTimeout))
+	client.SetWriteDeadline(newDeadline(s.config.writeTimeout))
+
+	s.handshake(ctx, client)
+}
+
+// finishSession runs the OnClose hook when the connection of the session ends.
+func (s *Server) finishSession(ctx context.Context, sess *session) {
+	// A session without a reason ended before the request was complete.
+	sess.close(CloseReasonProtocolError)
 
-	s.handshake(ctx, newConnection(conn))
+	s.hooks.onClose(ctx, sess.accessRecord())
 }
 
 func (s *Server) isActive() bool {
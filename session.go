@@ -0,0 +1,274 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons recorded when a session ends.
+const (
+	CloseReasonCompleted     = "completed"
+	CloseReasonRelayError    = "relay_error"
+	CloseReasonDialError     = "dial_error"
+	CloseReasonListenError   = "listen_error"
+	CloseReasonDenied        = "denied"
+	CloseReasonNotSupported  = "not_supported"
+	CloseReasonProtocolError = "protocol_error"
+	CloseReasonTerminated    = "terminated"
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// SessionInfo is a snapshot of an active session.
+type SessionInfo struct {
+	ID            string    `json:"id"`
+	ClientAddress string    `json:"client"`
+	Username      string    `json:"user,omitempty"`
+	Command       Command   `json:"command"`
+	Destination   string    `json:"destination,omitempty"`
+	StartTime     time.Time `json:"start_time"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	// UDP holds the statistics of a UDP association.
+	UDP *UDPStats `json:"udp,omitempty"`
+}
+
+// session holds the state of a client connection that is accumulated
+// while the request is served.
+type session struct {
+	mutex       sync.Mutex
+	id          string
+	startTime   time.Time
+	client      net.Addr
+	username    string
+	command     byte
+	destination string
+	resolved    string
+	reply       byte
+	replied     bool
+	// replyDeferred is set when the reply is sent before
+	// the outcome of the request is known.
+	replyDeferred bool
+	upload        atomic.Int64
+	download      atomic.Int64
+	closeReason   string
+	closers       []io.Closer
+	udp           *udpStats
+}
+
+func newSession(client net.Addr) *session {
+	return &session{
+		id:        rand.Text(),
+		startTime: time.Now(),
+		client:    client,
+	}
+}
+
+func contextWithSession(ctx context.Context, sess *session) context.Context {
+	return context.WithValue(ctx, sessionKey, sess)
+}
+
+// sessionFromContext returns the session of the context, a detached
+// session is returned when there is none so that callers need no checks.
+func sessionFromContext(ctx context.Context) *session {
+	if sess, ok := ctx.Value(sessionKey).(*session); ok {
+		return sess
+	}
+
+	return &session{}
+}
+
+func (s *session) setUsername(username string) {
+	s.mutex.Lock()
+	s.username = username
+	s.mutex.Unlock()
+}
+
+func (s *session) setRequest(command byte, destination string) {
+	s.mutex.Lock()
+	s.command = command
+	s.destination = destination
+	s.mutex.Unlock()
+}
+
+func (s *session) setResolved(resolved string) {
+	s.mutex.Lock()
+	s.resolved = resolved
+	s.mutex.Unlock()
+}
+
+func (s *session) setUDPStats(stats *udpStats) {
+	s.mutex.Lock()
+	s.udp = stats
+	s.mutex.Unlock()
+}
+
+func (s *session) setReply(code byte) {
+	s.mutex.Lock()
+	s.reply = code
+	s.replied = true
+	s.mutex.Unlock()
+}
+
+// deferReply makes the replies sent for the request not recorded,
+// the outcome of the request is recorded instead.
+func (s *session) deferReply() {
+	s.mutex.Lock()
+	s.replyDeferred = true
+	s.mutex.Unlock()
+}
+
+func (s *session) isReplyDeferred() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.replyDeferred
+}
+
+// close records the reason the session ended, only the first reason is kept.
+func (s *session) close(reason string) {
+	s.mutex.Lock()
+	if s.closeReason == "" {
+		s.closeReason = reason
+	}
+	s.mutex.Unlock()
+}
+
+// onTerminate registers a connection that is closed when the session is terminated.
+func (s *session) onTerminate(c io.Closer) {
+	s.mutex.Lock()
+	s.closers = append(s.closers, c)
+	s.mutex.Unlock()
+}
+
+func (s *session) terminate() {
+	s.close(CloseReasonTerminated)
+
+	s.mutex.Lock()
+	closers := s.closers
+	s.mutex.Unlock()
+
+	for _, c := range closers {
+		c.Close()
+	}
+}
+
+func (s *session) info() SessionInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	info := SessionInfo{
+		ID:            s.id,
+		Username:      s.username,
+		Command:       Command(s.command),
+		Destination:   s.destination,
+		StartTime:     s.startTime,
+		UploadBytes:   s.upload.Load(),
+		DownloadBytes: s.download.Load(),
+	}
+
+	if s.client != nil {
+		info.ClientAddress = s.client.String()
+	}
+
+	if s.udp != nil {
+		info.UDP = s.udp.snapshot()
+	}
+
+	return info
+}
+
+func (s *session) accessRecord() AccessRecord {
+	info := s.info()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return AccessRecord{
+		SessionID:           info.ID,
+		StartTime:           info.StartTime,
+		Duration:            time.Since(info.StartTime),
+		ClientAddress:       info.ClientAddress,
+		Username:            info.Username,
+		Command:             info.Command,
+		Destination:         info.Destination,
+		ResolvedDestination: s.resolved,
+		Reply:               s.reply,
+		Replied:             s.replied,
+		UploadBytes:         info.UploadBytes,
+		DownloadBytes:       info.DownloadBytes,
+		CloseReason:         s.closeReason,
+	}
+}
+
+type sessionRegistry struct {
+	mutex    sync.RWMutex
+	sessions map[string]*session
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+func (r *sessionRegistry) add(sess *session) {
+	r.mutex.Lock()
+	r.sessions[sess.id] = sess
+	r.mutex.Unlock()
+}
+
+func (r *sessionRegistry) delete(id string) {
+	r.mutex.Lock()
+	delete(r.sessions, id)
+	r.mutex.Unlock()
+}
+
+func (r *sessionRegistry) get(id string) (*session, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sess, ok := r.sessions[id]
+	return sess, ok
+}
+
+func (r *sessionRegistry) list() []*session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, sess := range r.sessions {
+		sessions = append(sessions, sess)
+	}
+
+	return sessions
+}
+
+// Sessions returns a snapshot of the active sessions.
+func (s *Server) Sessions() []SessionInfo {
+	sessions := s.sessions.list()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		infos = append(infos, sess.info())
+	}
+
+	return infos
+}
+
+// CloseSession terminates the session with the given ID by closing
+// its client connection and the connection to the destination.
+func (s *Server) CloseSession(id string) error {
+	sess, ok := s.sessions.get(id)
+	if !ok {
+		return errSessionNotFound
+	}
+
+	sess.terminate()
+
+	return nil
+}
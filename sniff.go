@@ -0,0 +1,274 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultSniffTimeout is the time to wait for the first bytes of a CONNECT stream.
+const defaultSniffTimeout = 300 * time.Millisecond
+
+const (
+	tlsRecordTypeHandshake   = 0x16
+	tlsHandshakeClientHello  = 0x01
+	tlsExtensionServerName   = 0x0000
+	tlsServerNameTypeHost    = 0x00
+	tlsRecordHeaderLength    = 5
+	tlsHandshakeHeaderLength = 4
+)
+
+var httpMethods = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ",
+}
+
+// sniff replies to the CONNECT request before the destination is dialed and
+// peeks at the first bytes of the stream for the TLS server name or the HTTP
+// Host of an IP destination. The rules are applied to the sniffed name and
+// the context passed to the Driver carries it. It reports false when the
+// rules deny the name, the reply already sent cannot report it. The reply is
+// recorded by the caller once the outcome of the request is known.
+func (s *Server) sniff(ctx context.Context, conn *connection, w ReplyWriter) (context.Context, bool) {
+	sessionFromContext(ctx).deferReply()
+
+	w.Reply(ReplySucceeded, "")
+
+	var host string
+
+	conn.peek(s.config.sniffTimeout, func(buffered []byte) bool {
+		var done bool
+
+		host, done = sniffHost(buffered)
+
+		return done
+	})
+
+	if host == "" {
+		return ctx, true
+	}
+
+	ctx = contextWithSniffedHost(ctx, host)
+
+	sessionSpanFromContext(ctx).SetAttributes(Attribute{Key: AttributeSniffedHost, Value: host})
+
+	s.logger.Info(ctx, "sniffed destination host", LogKeySniffedHost, host)
+
+	if !s.policy.Load().rules.IsAllowDestination(ctx, host) {
+		sessionFromContext(ctx).close(CloseReasonDenied)
+
+		s.metrics.RuleDenial(ctx)
+
+		s.recordReply(ctx, connectionNotAllowedByRuleSet)
+		return ctx, false
+	}
+
+	return ctx, true
+}
+
+// sniffHost returns the server name of a TLS ClientHello or the Host of an
+// HTTP request at the start of the stream. It reports false when more bytes
+// are needed to tell.
+func sniffHost(data []byte) (string, bool) {
+	if len(data) == 0 {
+		return "", false
+	}
+
+	if data[0] == tlsRecordTypeHandshake {
+		return sniffTLSServerName(data)
+	}
+
+	return sniffHTTPHost(data)
+}
+
+// sniffTLSServerName parses the server_name extension, RFC 6066 section 3,
+// of a ClientHello reassembled from the handshake records that carry it.
+func sniffTLSServerName(data []byte) (string, bool) {
+	var message []byte
+
+	for {
+		if len(data) < tlsRecordHeaderLength {
+			return "", false
+		}
+
+		if data[0] != tlsRecordTypeHandshake {
+			return "", true
+		}
+
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < tlsRecordHeaderLength+length {
+			return "", false
+		}
+
+		message = append(message, data[tlsRecordHeaderLength:tlsRecordHeaderLength+length]...)
+		data = data[tlsRecordHeaderLength+length:]
+
+		if len(message) < tlsHandshakeHeaderLength {
+			continue
+		}
+
+		size := tlsHandshakeHeaderLength + (int(message[1])<<16 | int(message[2])<<8 | int(message[3]))
+		if len(message) >= size {
+			return parseClientHello(message[:size])
+		}
+	}
+}
+
+// parseClientHello returns the server name of a ClientHello message.
+func parseClientHello(message []byte) (string, bool) {
+	r := tlsReader(message)
+
+	handshake, ok := r.next(1)
+	if !ok || handshake[0] != tlsHandshakeClientHello {
+		return "", true
+	}
+
+	// The length of the handshake, the version and the random.
+	if _, ok := r.next(3 + 2 + 32); !ok {
+		return "", true
+	}
+
+	// The session id, the cipher suites and the compression methods.
+	for _, prefix := range []int{1, 2, 1} {
+		if _, ok := r.vector(prefix); !ok {
+			return "", true
+		}
+	}
+
+	extensions, ok := r.vector(2)
+	if !ok {
+		return "", true
+	}
+
+	for len(extensions) > 0 {
+		kind, ok := extensions.next(2)
+		if !ok {
+			return "", true
+		}
+
+		body, ok := extensions.vector(2)
+		if !ok {
+			return "", true
+		}
+
+		if binary.BigEndian.Uint16(kind) != tlsExtensionServerName {
+			continue
+		}
+
+		names, ok := body.vector(2)
+		if !ok {
+			return "", true
+		}
+
+		for len(names) > 0 {
+			nameType, ok := names.next(1)
+			if !ok {
+				return "", true
+			}
+
+			name, ok := names.vector(2)
+			if !ok {
+				return "", true
+			}
+
+			if nameType[0] == tlsServerNameTypeHost {
+				return sniffedName(string(name)), true
+			}
+		}
+	}
+
+	return "", true
+}
+
+// tlsReader reads the fields of a TLS message.
+type tlsReader []byte
+
+func (r *tlsReader) next(n int) (tlsReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+
+	field := (*r)[:n]
+	*r = (*r)[n:]
+
+	return field, true
+}
+
+// vector reads a variable-length field with a length prefix of the given size.
+func (r *tlsReader) vector(prefix int) (tlsReader, bool) {
+	header, ok := r.next(prefix)
+	if !ok {
+		return nil, false
+	}
+
+	var length int
+
+	for _, b := range header {
+		length = length<<8 | int(b)
+	}
+
+	return r.next(length)
+}
+
+// sniffHTTPHost parses the Host header of an HTTP/1.x request.
+func sniffHTTPHost(data []byte) (string, bool) {
+	var isHTTP bool
+
+	for _, method := range httpMethods {
+		if len(data) < len(method) && strings.HasPrefix(method, string(data)) {
+			return "", false
+		}
+
+		if bytes.HasPrefix(data, []byte(method)) {
+			isHTTP = true
+			break
+		}
+	}
+
+	if !isHTTP {
+		return "", true
+	}
+
+	// The request line.
+	_, data, ok := bytes.Cut(data, []byte("\r\n"))
+	if !ok {
+		return "", false
+	}
+
+	for {
+		line, rest, ok := bytes.Cut(data, []byte("\r\n"))
+		if !ok {
+			return "", false
+		}
+
+		if len(line) == 0 {
+			return "", true
+		}
+
+		if key, value, ok := bytes.Cut(line, []byte(":")); ok && strings.EqualFold(string(key), "Host") {
+			host := strings.TrimSpace(string(value))
+
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+
+			return sniffedName(host), true
+		}
+
+		data = rest
+	}
+}
+
+// sniffedName returns the name in lower case without the trailing dot,
+// an IP address is not a name.
+func sniffedName(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return ""
+	}
+
+	return name
+}
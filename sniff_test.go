@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// clientHello returns the first bytes a TLS client sends for the server name.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		defer client.Close()
+
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+
+	buff := make([]byte, 4096)
+
+	n, err := server.Read(buff)
+	require.NoError(t, err)
+
+	return buff[:n]
+}
+
+// splitRecord splits the body of a TLS record into two records,
+// the first one with n bytes.
+func splitRecord(record []byte, n int) []byte {
+	header, body := record[:tlsRecordHeaderLength], record[tlsRecordHeaderLength:]
+
+	var split []byte
+
+	for _, fragment := range [][]byte{body[:n], body[n:]} {
+		split = append(split, header[:3]...)
+		split = binary.BigEndian.AppendUint16(split, uint16(len(fragment)))
+		split = append(split, fragment...)
+	}
+
+	return split
+}
+
+func TestSniffHost(t *testing.T) {
+	hello := clientHello(t, "example.com")
+
+	// The ClientHello split across two records.
+	split := splitRecord(hello, 100)
+
+	testCases := map[string]struct {
+		data []byte
+		host string
+		done bool
+	}{
+		"tls_server_name": {
+			data: hello,
+			host: "example.com",
+			done: true,
+		},
+		"tls_partial_record": {
+			data: hello[:len(hello)-1],
+		},
+		"tls_split_records": {
+			data: split,
+			host: "example.com",
+			done: true,
+		},
+		"tls_partial_second_record": {
+			data: split[:len(split)-1],
+		},
+		"tls_mixed_case_server_name": {
+			data: clientHello(t, "ExAmPlE.CoM"),
+			host: "example.com",
+			done: true,
+		},
+		"tls_without_server_name": {
+			data: clientHello(t, ""),
+			done: true,
+		},
+		"http_host": {
+			data: []byte("GET /ping HTTP/1.1\r\nUser-Agent: test\r\nhost: example.com:8080\r\n\r\n"),
+			host: "example.com",
+			done: true,
+		},
+		"http_partial_method": {
+			data: []byte("PO"),
+		},
+		"http_partial_headers": {
+			data: []byte("GET / HTTP/1.1\r\nUser-Agent: test\r\n"),
+		},
+		"http_without_host": {
+			data: []byte("GET / HTTP/1.0\r\n\r\n"),
+			done: true,
+		},
+		"http_ip_host": {
+			data: []byte("GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n"),
+			done: true,
+		},
+		"other_protocol": {
+			data: []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+			done: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			host, done := sniffHost(tc.data)
+
+			assert.Equal(t, tc.host, host)
+			assert.Equal(t, tc.done, done)
+		})
+	}
+}
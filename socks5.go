@@ -3,7 +3,12 @@ package socks5
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/sync/errgroup"
 )
@@ -37,32 +42,61 @@ const (
 	addressTypeNotSupported       byte = 0x08
 )
 
+func replyName(code byte) string {
+	switch code {
+	case connectionSuccessful:
+		return "succeeded"
+	case generalSOCKSserverFailure:
+		return "general_failure"
+	case connectionNotAllowedByRuleSet:
+		return "not_allowed_by_ruleset"
+	case networkUnreachable:
+		return "network_unreachable"
+	case hostUnreachable:
+		return "host_unreachable"
+	case connectionRefused:
+		return "connection_refused"
+	case commandNotSupported:
+		return "command_not_supported"
+	case addressTypeNotSupported:
+		return "address_type_not_supported"
+	default:
+		return fmt.Sprintf("0x%02x", code)
+	}
+}
+
 func (s *Server) handshake(ctx context.Context, conn *connection) {
 	version, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read protocol version: "+err.Error())
+		s.metrics.HandshakeFailure(ctx)
+		s.logger.Error(ctx, "failed to read protocol version", LogKeyError, err)
 		return
 	}
 
 	if version != version5 {
+		s.metrics.HandshakeFailure(ctx)
 		return
 	}
 
 	numMethods, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read number of authentication methods: "+err.Error())
+		s.metrics.HandshakeFailure(ctx)
+		s.logger.Error(ctx, "failed to read number of authentication methods", LogKeyError, err)
 		return
 	}
 
 	methods := make([]byte, numMethods)
 	if _, err := conn.read(methods); err != nil {
-		s.logger.Error(ctx, "failed to read authentication methods: "+err.Error())
+		s.metrics.HandshakeFailure(ctx)
+		s.logger.Error(ctx, "failed to read authentication methods", LogKeyError, err)
 		return
 	}
 
 	method := s.choiceAuthenticationMethod(methods)
 	switch method {
 	case noAuthenticationRequired:
+		s.hooks.onAuth(ctx, "", noAuthenticationRequired, true)
+
 		s.response(ctx, conn, version5, noAuthenticationRequired)
 
 		s.acceptRequest(ctx, conn)
@@ -71,6 +105,8 @@ func (s *Server) handshake(ctx context.Context, conn *connection) {
 
 		s.usernamePasswordAuthenticate(ctx, conn)
 	default:
+		s.metrics.HandshakeFailure(ctx)
+
 		s.response(ctx, conn, version5, noAcceptableMethods)
 	}
 }
@@ -78,7 +114,7 @@ func (s *Server) handshake(ctx context.Context, conn *connection) {
 func (s *Server) acceptRequest(ctx context.Context, conn *connection) {
 	version, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read protocol version: "+err.Error())
+		s.logger.Error(ctx, "failed to read protocol version", LogKeyError, err)
 		return
 	}
 
@@ -88,13 +124,17 @@ func (s *Server) acceptRequest(ctx context.Context, conn *connection) {
 
 	command, err := conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read command: "+err.Error())
+		s.logger.Error(ctx, "failed to read command", LogKeyError, err)
 		return
 	}
 
+	ctx = contextWithCommand(ctx, command)
+
+	sess := sessionFromContext(ctx)
+
 	// Reserved byte: 0x00
 	if _, err := conn.readByte(); err != nil {
-		s.logger.Error(ctx, "failed to read reserved byte: "+err.Error())
+		s.logger.Error(ctx, "failed to read reserved byte", LogKeyError, err)
 		return
 	}
 
@@ -102,7 +142,7 @@ func (s *Server) acceptRequest(ctx context.Context, conn *connection) {
 
 	addr.Type, err = conn.readByte()
 	if err != nil {
-		s.logger.Error(ctx, "failed to read address type: "+err.Error())
+		s.logger.Error(ctx, "failed to read address type", LogKeyError, err)
 		return
 	}
 
@@ -110,205 +150,368 @@ func (s *Server) acceptRequest(ctx context.Context, conn *connection) {
 	case addressTypeIPv4:
 		addr.IP = make(net.IP, net.IPv4len)
 		if _, err := conn.read(addr.IP); err != nil {
-			s.logger.Error(ctx, "failed to read IPv4 address: "+err.Error())
+			s.logger.Error(ctx, "failed to read IPv4 address", LogKeyError, err)
 			return
 		}
 	case addressTypeFQDN:
 		addr.DomainLen, err = conn.readByte()
 		if err != nil {
-			s.logger.Error(ctx, "failed to read domain length: "+err.Error())
+			s.logger.Error(ctx, "failed to read domain length", LogKeyError, err)
 			return
 		}
 
 		addr.Domain = make([]byte, addr.DomainLen)
 		if _, err := conn.read(addr.Domain); err != nil {
-			s.logger.Error(ctx, "failed to read domain: "+err.Error())
+			s.logger.Error(ctx, "failed to read domain", LogKeyError, err)
 			return
 		}
 	case addressTypeIPv6:
 		addr.IP = make(net.IP, net.IPv6len)
 		if _, err := conn.read(addr.IP); err != nil {
-			s.logger.Error(ctx, "failed to read IPv6 address: "+err.Error())
+			s.logger.Error(ctx, "failed to read IPv6 address", LogKeyError, err)
 			return
 		}
 	default:
+		sess.close(CloseReasonNotSupported)
+
 		s.replyRequest(ctx, conn, addressTypeNotSupported, &addr)
 		return
 	}
 
 	addr.Port = make([]byte, 2)
 	if _, err := conn.read(addr.Port); err != nil {
-		s.logger.Error(ctx, "failed to read port: "+err.Error())
+		s.logger.Error(ctx, "failed to read port", LogKeyError, err)
 		return
 	}
 
-	if !s.rules.IsAllowDestination(ctx, addr.getDomainOrIP()) {
+	ctx = contextWithDestination(ctx, addr.String())
+
+	sess.setRequest(command, addr.String())
+
+	sessionSpanFromContext(ctx).SetAttributes(
+		Attribute{Key: AttributeCommand, Value: Command(command).String()},
+		Attribute{Key: AttributeDestination, Value: addr.String()},
+	)
+
+	if !s.isAllowRequest(ctx, command, &addr) || !s.hooks.onRequest(ctx, command, addr.String()) {
+		sess.close(CloseReasonDenied)
+
+		s.metrics.RuleDenial(ctx)
+
 		s.replyRequest(ctx, conn, connectionNotAllowedByRuleSet, &addr)
 		return
 	}
 
-	switch command {
-	case connect:
-		if !s.rules.IsAllowCommand(ctx, connect) {
-			s.replyRequest(ctx, conn, connectionNotAllowedByRuleSet, &addr)
-			return
-		}
+	w := &replyWriter{
+		server: s,
+		ctx:    ctx,
+		req: &Request{
+			Command:     Command(command),
+			Destination: addr.String(),
+			RemoteAddr:  conn.RemoteAddr(),
+			conn:        conn,
+			addr:        &addr,
+		},
+	}
+
+	s.handler.ServeSOCKS(ctx, w.req, w)
+
+	if !w.replied {
+		w.Reply(ReplyGeneralFailure, "")
+	}
+}
+
+// serveRequest is the built-in handler at the end of the middleware chain.
+func (s *Server) serveRequest(ctx context.Context, req *Request, w ReplyWriter) {
+	addr, err := req.address()
+	if err != nil {
+		sessionFromContext(ctx).close(CloseReasonNotSupported)
+
+		s.logger.Error(ctx, "invalid destination", LogKeyDestination, req.Destination, LogKeyError, err)
+
+		w.Reply(ReplyAddressTypeNotSupported, "")
+		return
+	}
+
+	// A destination rewritten by a middleware has not passed the rules.
+	if addr != req.addr && !s.policy.Load().rules.IsAllowDestination(ctx, addr.getDomainOrIP()) {
+		sessionFromContext(ctx).close(CloseReasonDenied)
 
-		s.connect(ctx, conn, &addr)
+		s.metrics.RuleDenial(ctx)
+
+		w.Reply(ReplyNotAllowedByRuleSet, "")
+		return
+	}
+
+	switch byte(req.Command) {
+	case connect:
+		s.connect(ctx, req.conn, w, addr)
 	case udpAssociate:
-		if !s.rules.IsAllowCommand(ctx, udpAssociate) {
-			s.replyRequest(ctx, conn, connectionNotAllowedByRuleSet, &addr)
+		s.udpAssociate(ctx, req.conn, w, addr)
+	default:
+		if handler, ok := s.commandHandlers[req.Command]; ok {
+			handler.ServeSOCKS(ctx, req, w)
 			return
 		}
 
-		s.udpAssociate(ctx, conn, &addr)
+		sessionFromContext(ctx).close(CloseReasonNotSupported)
+
+		w.Reply(ReplyCommandNotSupported, "")
+	}
+}
+
+func (s *Server) logAccess(ctx context.Context, sess *session) {
+	// A session without a reason ended before the request was complete.
+	sess.close(CloseReasonProtocolError)
+
+	s.accessLogger.LogAccess(ctx, sess.accessRecord())
+}
+
+func (s *Server) isAllowRequest(ctx context.Context, command byte, addr *address) bool {
+	ctx, span := s.tracer.Start(ctx, SpanRules)
+	defer span.End()
+
+	if !s.policy.Load().rules.IsAllowDestination(ctx, addr.getDomainOrIP()) {
+		return false
+	}
+
+	_, handled := s.commandHandlers[Command(command)]
+
+	switch {
+	case command == byte(UDPOverTCP):
+		// UDPOverTCP relays the datagrams of an association.
+		return s.policy.Load().rules.IsAllowCommand(ctx, udpAssociate)
+	case command == connect, command == udpAssociate, handled:
+		return s.policy.Load().rules.IsAllowCommand(ctx, command)
 	default:
-		s.replyRequest(ctx, conn, commandNotSupported, &addr)
+		// A command the server does not serve is replied as not supported.
+		return true
 	}
 }
 
-func (s *Server) connect(ctx context.Context, conn *connection, addr *address) {
-	target, err := s.driver.Dial("tcp", addr.String())
+func (s *Server) connect(ctx context.Context, conn *connection, w ReplyWriter, addr *address) {
+	sess := sessionFromContext(ctx)
+
+	sniffing := s.config.sniffTimeout > 0 && addr.Type != addressTypeFQDN
+
+	if sniffing {
+		var ok bool
+
+		if ctx, ok = s.sniff(ctx, conn, w); !ok {
+			return
+		}
+	}
+
+	dialCtx, cancel := context.WithCancel(ctx)
+	stop := conn.cancelOnClose(cancel)
+
+	target, err := s.dial(dialCtx, "tcp", addr)
+
+	stop()
+	cancel()
+
+	s.hooks.onDial(ctx, addr.String(), remoteAddress(target), err)
+
 	if err != nil {
-		s.replyRequestWithError(ctx, conn, err, addr)
+		sess.close(CloseReasonDialError)
+
+		// The success reply is already sent, the reply code of the dial is recorded only.
+		if sniffing {
+			s.recordReply(ctx, byte(replyCodeFromError(err)))
+		}
+
+		w.Reply(replyCodeFromError(err), "")
 
-		s.logger.Error(ctx, "dial "+addr.String()+": "+err.Error())
+		s.logger.Error(ctx, "failed to dial destination", LogKeyError, err)
 		return
 	}
 	defer target.Close()
 
-	s.replyRequest(ctx, conn, connectionSuccessful, addr)
+	if sniffing {
+		s.recordReply(ctx, connectionSuccessful)
+	}
+
+	sess.onTerminate(target)
+	sess.setResolved(target.RemoteAddr().String())
+
+	w.Reply(ReplySucceeded, s.boundAddress(target))
+
+	s.logger.Info(ctx, "dial destination", LogKeyResolved, target.RemoteAddr())
 
-	s.logger.Info(ctx, "dial "+addr.String())
+	_, span := s.tracer.Start(ctx, SpanRelay)
+	defer span.End()
 
-	var g errgroup.Group
+	var (
+		g        errgroup.Group
+		upload   int64
+		download int64
+	)
 
 	g.Go(func() error {
-		n, err := relay(target, conn)
+		n, err := relay(target, conn, s.relayPool, &sess.upload)
 		s.metrics.UploadBytes(ctx, n)
+		upload = n
 		return err
 	})
 
 	g.Go(func() error {
-		n, err := relay(conn, target)
+		n, err := relay(conn, target, s.relayPool, &sess.download)
 		s.metrics.DownloadBytes(ctx, n)
+		download = n
 		return err
 	})
 
-	if err = g.Wait(); err != nil {
-		s.logger.Error(ctx, "error sync wait group: "+err.Error())
-	}
-}
+	err = g.Wait()
+
+	s.recordRelay(ctx, span, upload, download, err)
 
-func (s *Server) udpAssociate(ctx context.Context, conn *connection, addr *address) {
-	packetConn, err := s.driver.ListenPacket("udp", net.JoinHostPort(s.config.host, addr.Port.String()))
 	if err != nil {
-		s.replyRequestWithError(ctx, conn, err, addr)
+		sess.close(CloseReasonRelayError)
 
-		s.logger.Error(ctx, "error listen udp: "+err.Error())
-		return
+		s.logger.Error(ctx, "error sync wait group", LogKeyError, err)
 	}
 
-	conn.onClose(func() {
-		if err := packetConn.Close(); err != nil {
-			s.logger.Error(ctx, "error close udp listener: "+err.Error())
+	sess.close(CloseReasonCompleted)
+}
+
+func (s *Server) dial(ctx context.Context, network string, addr *address) (net.Conn, error) {
+	_, span := s.tracer.Start(ctx, SpanDial)
+	defer span.End()
+
+	span.SetAttributes(Attribute{Key: AttributeDestination, Value: addr.String()})
+
+	var (
+		attempts atomic.Int32
+		hooks    hookQueue
+	)
+
+	// The hooks run aside so that a slow hook does not hold up the race
+	// of the attempts, they are done before the dial returns.
+	defer hooks.wait()
+
+	ctx = ContextWithDialReporter(ctx, func(attempt DialAttempt) {
+		attempts.Add(1)
+
+		hooks.push(func() {
+			s.hooks.onDialAttempt(ctx, attempt)
+		})
+
+		if attempt.Err != nil {
+			span.RecordError(attempt.Err)
+
+			s.logger.Warn(ctx, "dial attempt failed", LogKeyResolved, attempt.Address, LogKeyError, attempt.Err)
 		}
 	})
 
-	go conn.keepAlive()
+	start := time.Now()
 
-	var port port
+	var (
+		target net.Conn
+		err    error
+	)
 
-	port.fromAddress(packetConn.LocalAddr())
+	if dialer, ok := s.driver.(ContextDialer); ok {
+		target, err = dialer.DialContext(ctx, network, addr.String())
+	} else {
+		target, err = s.driver.Dial(network, addr.String())
+	}
 
-	s.replyRequest(ctx, conn, connectionSuccessful, &address{
-		Type: addressTypeIPv4,
-		IP:   s.config.publicIP,
-		Port: port,
-	})
+	s.metrics.DialDuration(ctx, time.Since(start))
+
+	span.SetAttributes(Attribute{Key: AttributeDialAttempts, Value: int(attempts.Load())})
 
-	buff := s.bytePool.get()
-	defer s.bytePool.put(buff)
+	if target != nil {
+		span.SetAttributes(Attribute{Key: AttributeResolved, Value: target.RemoteAddr().String()})
+	}
 
-	natTable := newNatTable()
+	span.RecordError(err)
 
-	stop := natTable.cleanup(s.config.natCleanupPeriod, s.config.ttlPacket)
-	defer stop()
+	return target, err
+}
 
-	s.logger.Info(ctx, "start of udp datagram forwarding")
+// boundAddress returns the local address of the outbound connection for the
+// CONNECT reply, RFC 1928 section 6, or an empty address that echoes the
+// requested destination when the legacy reply is enabled.
+func (s *Server) boundAddress(target net.Conn) string {
+	if s.config.echoConnectReply {
+		return ""
+	}
 
-	for conn.isActive() {
-		n, clientAddress, err := packetConn.ReadFrom(buff)
-		if err != nil {
-			if !isClosedListenerError(err) {
-				s.logger.Error(ctx, "failed to read from packet connection: "+err.Error())
-			}
-			continue
-		}
+	host, port, err := net.SplitHostPort(target.LocalAddr().String())
+	if err != nil {
+		return ""
+	}
 
-		if sourceAddress, packet, ok := natTable.get(clientAddress); ok {
-			packet.encode(buff[:n])
+	// The zone of a link-local address can not be encoded.
+	host, _, _ = strings.Cut(host, "%")
 
-			s.metrics.DownloadBytes(ctx, packet.payload.len())
+	if net.ParseIP(host) == nil {
+		return ""
+	}
 
-			packetConn.SetWriteDeadline(newDeadline(s.config.packetWriteTimeout))
-			if _, err := packetConn.WriteTo(packet.payload, sourceAddress); err != nil {
-				if !isClosedListenerError(err) {
-					s.logger.Error(ctx, "failed writing to packet connection: "+err.Error())
-				}
-			}
+	return net.JoinHostPort(host, port)
+}
 
-			natTable.delete(clientAddress)
-			continue
-		}
+func (s *Server) listenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	if listener, ok := s.driver.(ContextPacketListener); ok {
+		return listener.ListenPacketContext(ctx, network, address)
+	}
 
-		if conn.equalAddresses(clientAddress) {
-			var packet packet
+	return s.driver.ListenPacket(network, address)
+}
 
-			if err := packet.decode(buff[:n]); err != nil {
-				s.logger.Error(ctx, "failed to unpack packet: "+err.Error())
-				continue
-			}
+func remoteAddress(conn net.Conn) net.Addr {
+	if conn == nil {
+		return nil
+	}
 
-			if !s.rules.IsAllowDestination(ctx, packet.address.getDomainOrIP()) {
-				continue
-			}
+	return conn.RemoteAddr()
+}
 
-			destAddress, err := s.driver.Resolve("udp", packet.address.String())
-			if err != nil {
-				s.logger.Error(ctx, "failed to resolve target UDP address: "+err.Error())
-				continue
-			}
+func (s *Server) resolve(ctx context.Context, network string, addr *address) (net.Addr, error) {
+	return s.resolveDestination(ctx, network, addr.String())
+}
 
-			s.metrics.UploadBytes(ctx, packet.payload.len())
+func (s *Server) resolveDestination(ctx context.Context, network, destination string) (net.Addr, error) {
+	_, span := s.tracer.Start(ctx, SpanResolve)
+	defer span.End()
 
-			packetConn.SetWriteDeadline(newDeadline(s.config.packetWriteTimeout))
-			if _, err := packetConn.WriteTo(packet.payload, destAddress); err != nil {
-				if !isClosedListenerError(err) {
-					s.logger.Error(ctx, "failed writing to packet connection: "+err.Error())
-				}
-				continue
-			}
+	span.SetAttributes(Attribute{Key: AttributeDestination, Value: destination})
 
-			packet.payload.reset()
+	resolved, err := s.driver.Resolve(network, destination)
+	span.RecordError(err)
 
-			natTable.set(clientAddress, destAddress, &packet)
-		}
+	return resolved, err
+}
+
+// recordRelay records the relayed bytes on the spans of the session.
+func (s *Server) recordRelay(ctx context.Context, span Span, upload, download int64, err error) {
+	attrs := []Attribute{
+		{Key: AttributeUploadBytes, Value: upload},
+		{Key: AttributeDownloadBytes, Value: download},
 	}
 
-	s.logger.Info(ctx, "udp datagram forwarding complete")
+	span.SetAttributes(attrs...)
+	span.RecordError(err)
+
+	sessionSpanFromContext(ctx).SetAttributes(attrs...)
 }
 
-func (s *Server) replyRequestWithError(ctx context.Context, conn *connection, err error, addr *address) {
+func replyCodeFromError(err error) ReplyCode {
+	var dialErr *DialError
+	if errors.As(err, &dialErr) {
+		return dialErr.replyCode()
+	}
+
 	switch {
 	case isNetworkUnreachableError(err):
-		s.replyRequest(ctx, conn, networkUnreachable, addr)
+		return ReplyNetworkUnreachable
 	case isNoSuchHostError(err):
-		s.replyRequest(ctx, conn, hostUnreachable, addr)
+		return ReplyHostUnreachable
 	case isConnectionRefusedError(err):
-		s.replyRequest(ctx, conn, connectionRefused, addr)
+		return ReplyConnectionRefused
 	default:
-		s.replyRequest(ctx, conn, generalSOCKSserverFailure, addr)
+		return ReplyGeneralFailure
 	}
 }
 
@@ -330,9 +533,22 @@ func (s *Server) replyRequest(ctx context.Context, conn *connection, status byte
 
 	fields = append(fields, addr.Port...)
 
+	if !sessionFromContext(ctx).isReplyDeferred() {
+		s.recordReply(ctx, status)
+	}
+
 	s.response(ctx, conn, version5, status, fields...)
 }
 
+// recordReply records the reply code in the metrics, the session and the span.
+func (s *Server) recordReply(ctx context.Context, status byte) {
+	s.metrics.Reply(ctx, status)
+
+	sessionFromContext(ctx).setReply(status)
+
+	sessionSpanFromContext(ctx).SetAttributes(Attribute{Key: AttributeReply, Value: replyName(status)})
+}
+
 func (s *Server) response(ctx context.Context, conn *connection, version, status byte, fields ...byte) {
 	res := []byte{
 		version,
@@ -342,6 +558,6 @@ func (s *Server) response(ctx context.Context, conn *connection, version, status
 	res = append(res, fields...)
 
 	if _, err := conn.write(res); err != nil {
-		s.logger.Error(ctx, "failed to send a response to the client: "+err.Error())
+		s.logger.Error(ctx, "failed to send a response to the client", LogKeyError, err)
 	}
 }
@@ -1,14 +1,21 @@
 package socks5_test
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/proxy"
 
 	"github.com/TuanKiri/socks5"
@@ -285,3 +292,1711 @@ func TestProxyUDPAssociate(t *testing.T) {
 		assert.Equalf(t, packet, response, name)
 	}
 }
+
+func TestProxyUDPAssociateManyReplies(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1172),
+	)
+
+	// Two destinations that answer every datagram three times
+	destinations := make([]*net.UDPAddr, 2)
+
+	for i := range destinations {
+		packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			packetConn.Close()
+		})
+
+		destinations[i] = packetConn.LocalAddr().(*net.UDPAddr)
+
+		go func() {
+			buf := make([]byte, 1024)
+
+			for {
+				n, addr, err := packetConn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+
+				for j := range 3 {
+					packetConn.WriteTo(fmt.Appendf(nil, "%s-%d", buf[:n], j), addr)
+				}
+			}
+		}()
+	}
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	udpConn := associateUDP(t, "127.0.0.1:1172")
+
+	for i, destination := range destinations {
+		_, err := udpConn.Write(append(udpHeader(destination), fmt.Sprintf("ping%d", i)...))
+		require.NoError(t, err)
+	}
+
+	want := map[string]bool{}
+	for i, destination := range destinations {
+		for j := range 3 {
+			want[fmt.Sprintf("%s ping%d-%d", destination, i, j)] = true
+		}
+	}
+
+	got := map[string]bool{}
+
+	for range want {
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, 1024)
+		n, err := udpConn.Read(buf)
+		require.NoError(t, err)
+
+		got[fmt.Sprintf("%s %s", udpHeaderSource(buf), buf[10:n])] = true
+	}
+
+	assert.Equal(t, want, got)
+}
+
+func TestProxyUDPFiltering(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("remote hosts are emulated with the linux loopback network")
+	}
+
+	listen := func(address string) net.PacketConn {
+		packetConn, err := net.ListenPacket("udp", address)
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			packetConn.Close()
+		})
+
+		return packetConn
+	}
+
+	// The destination answers from its own address, from another port
+	// of the same host and from another host.
+	destination := listen("127.0.0.2:0")
+	samePort := listen("127.0.0.2:0")
+	otherHost := listen("127.0.0.3:0")
+
+	go func() {
+		buf := make([]byte, 1024)
+
+		for {
+			n, addr, err := destination.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			for _, packetConn := range []net.PacketConn{destination, samePort, otherHost} {
+				packetConn.WriteTo(buf[:n], addr)
+			}
+		}
+	}()
+
+	cases := map[string]struct {
+		port    int
+		options []socks5.Option
+		want    []net.Addr
+	}{
+		"address_and_port_dependent": {
+			port: 1173,
+			want: []net.Addr{destination.LocalAddr()},
+		},
+		"address_dependent": {
+			port:    1174,
+			options: []socks5.Option{socks5.WithUDPFiltering(socks5.AddressDependentFiltering)},
+			want:    []net.Addr{destination.LocalAddr(), samePort.LocalAddr()},
+		},
+		"endpoint_independent": {
+			port:    1175,
+			options: []socks5.Option{socks5.WithUDPFiltering(socks5.EndpointIndependentFiltering)},
+			want:    []net.Addr{destination.LocalAddr(), samePort.LocalAddr(), otherHost.LocalAddr()},
+		},
+		"endpoint_independent_with_rules": {
+			port: 1176,
+			options: []socks5.Option{
+				socks5.WithUDPFiltering(socks5.EndpointIndependentFiltering),
+				socks5.WithBlockListHosts("127.0.0.3"),
+			},
+			want: []net.Addr{destination.LocalAddr(), samePort.LocalAddr()},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			go runProxy(append(tc.options,
+				socks5.WithLogger(socks5.NopLogger),
+				socks5.WithPort(tc.port),
+			)...)
+
+			// Wait for socks5 proxy to start
+			time.Sleep(100 * time.Millisecond)
+
+			udpConn := associateUDP(t, fmt.Sprintf("127.0.0.1:%d", tc.port))
+
+			_, err := udpConn.Write(append(udpHeader(destination.LocalAddr().(*net.UDPAddr)), "ping"...))
+			require.NoError(t, err)
+
+			var got []string
+
+			for {
+				udpConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+				buf := make([]byte, 1024)
+				n, err := udpConn.Read(buf)
+				if err != nil {
+					break
+				}
+
+				assert.Equal(t, "ping", string(buf[10:n]))
+
+				got = append(got, udpHeaderSource(buf).String())
+			}
+
+			want := make([]string, 0, len(tc.want))
+			for _, addr := range tc.want {
+				want = append(want, addr.String())
+			}
+
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+}
+
+func TestProxyUDPFragmentation(t *testing.T) {
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	// Fragment 1, fragment 2 and fragment 3 that ends the sequence.
+	fragments := [][]byte{
+		append(udpHeader(echo), "hello "...),
+		append(udpHeader(echo), "fragmented "...),
+		append(udpHeader(echo), "world"...),
+	}
+	fragments[0][2] = 0x01
+	fragments[1][2] = 0x02
+	fragments[2][2] = 0x83
+
+	t.Run("enabled", func(t *testing.T) {
+		go runProxy(
+			socks5.WithLogger(socks5.NopLogger),
+			socks5.WithPort(1177),
+			socks5.WithUDPFragmentation(20),
+		)
+
+		// Wait for socks5 proxy to start
+		time.Sleep(100 * time.Millisecond)
+
+		udpConn := associateUDP(t, "127.0.0.1:1177")
+
+		for _, datagram := range fragments {
+			_, err := udpConn.Write(datagram)
+			require.NoError(t, err)
+		}
+
+		// The reply is fragmented to fit in the client MTU.
+		var (
+			reply []byte
+			frag  byte
+		)
+
+		for frag&0x80 == 0 {
+			udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, err := udpConn.Read(buf)
+			require.NoError(t, err)
+			require.LessOrEqual(t, n, 20)
+
+			assert.Equal(t, frag+1, buf[2]&^0x80)
+			frag = buf[2]
+
+			reply = append(reply, buf[10:n]...)
+		}
+
+		assert.Equal(t, "hello fragmented world", string(reply))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		go runProxy(
+			socks5.WithLogger(socks5.NopLogger),
+			socks5.WithPort(1178),
+		)
+
+		// Wait for socks5 proxy to start
+		time.Sleep(100 * time.Millisecond)
+
+		udpConn := associateUDP(t, "127.0.0.1:1178")
+
+		for _, datagram := range fragments {
+			_, err := udpConn.Write(datagram)
+			require.NoError(t, err)
+		}
+
+		udpConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+		_, err := udpConn.Read(make([]byte, 1024))
+		assert.Error(t, err)
+
+		// A standalone datagram is still forwarded.
+		_, err = udpConn.Write(append(udpHeader(echo), "ping"...))
+		require.NoError(t, err)
+
+		udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, 1024)
+		n, err := udpConn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[10:n]))
+	})
+}
+
+func TestProxyUDPClientAddress(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1179),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	dial := func(relay *net.UDPAddr) *net.UDPConn {
+		udpConn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, relay)
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			udpConn.Close()
+		})
+
+		return udpConn
+	}
+
+	// ping reports whether the datagram sent through the relay is echoed.
+	ping := func(udpConn *net.UDPConn) bool {
+		_, err := udpConn.Write(append(udpHeader(echo), "ping"...))
+		require.NoError(t, err)
+
+		udpConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+		buf := make([]byte, 1024)
+		n, err := udpConn.Read(buf)
+
+		return err == nil && string(buf[10:n]) == "ping"
+	}
+
+	t.Run("declared", func(t *testing.T) {
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer client.Close()
+
+		relay := requestUDPAssociate(t, "127.0.0.1:1179", udpHeader(client.LocalAddr().(*net.UDPAddr))[3:])
+
+		// Another socket of the client host is not the declared address.
+		assert.False(t, ping(dial(relay)))
+
+		_, err = client.WriteTo(append(udpHeader(echo), "ping"...), relay)
+		require.NoError(t, err)
+
+		client.SetReadDeadline(time.Now().Add(time.Second))
+
+		buf := make([]byte, 1024)
+		n, _, err := client.ReadFrom(buf)
+		require.NoError(t, err)
+		assert.Equal(t, "ping", string(buf[10:n]))
+	})
+
+	t.Run("learned", func(t *testing.T) {
+		relay := requestUDPAssociate(t, "127.0.0.1:1179", udpHeader(&net.UDPAddr{IP: net.IPv4zero})[3:])
+
+		first := dial(relay)
+		assert.True(t, ping(first))
+
+		// The first datagram set the client address.
+		assert.False(t, ping(dial(relay)))
+		assert.True(t, ping(first))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "[::1]:1179")
+		if err != nil {
+			t.Skip("no IPv6 loopback")
+		}
+		conn.Close()
+
+		relay := requestUDPAssociate(t, "[::1]:1179", append([]byte{0x04}, make([]byte, net.IPv6len+2)...))
+		assert.Equal(t, "::1", relay.IP.String())
+
+		udpConn, err := net.DialUDP("udp", nil, relay)
+		require.NoError(t, err)
+		defer udpConn.Close()
+
+		assert.True(t, ping(udpConn))
+	})
+}
+
+func TestProxyUDPSharedRelay(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1180),
+		socks5.WithUDPRelayPorts(1181, 1182, 1191),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	t.Run("demultiplex", func(t *testing.T) {
+		var clients []*net.UDPConn
+
+		for range 3 {
+			udpConn := associateUDP(t, "127.0.0.1:1180")
+
+			port := udpConn.RemoteAddr().(*net.UDPAddr).Port
+			assert.Contains(t, []int{1181, 1182, 1191}, port)
+
+			clients = append(clients, udpConn)
+		}
+
+		for i, udpConn := range clients {
+			_, err := udpConn.Write(append(udpHeader(echo), fmt.Sprintf("ping%d", i)...))
+			require.NoError(t, err)
+		}
+
+		for i, udpConn := range clients {
+			udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, err := udpConn.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("ping%d", i), string(buf[10:n]))
+		}
+	})
+
+	t.Run("client_address_in_use", func(t *testing.T) {
+		client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer client.Close()
+
+		declared := udpHeader(client.LocalAddr().(*net.UDPAddr))[3:]
+
+		requestUDPAssociate(t, "127.0.0.1:1180", declared)
+
+		conn, err := net.Dial("tcp", "127.0.0.1:1180")
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write(append([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00}, declared...))
+		require.NoError(t, err)
+
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x05, 0x00, 0x05, byte(socks5.ReplyGeneralFailure)}, reply)
+	})
+
+	t.Run("same_destination", func(t *testing.T) {
+		destination, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		require.NoError(t, err)
+		defer destination.Close()
+
+		// More clients than relay ports, so that two of them share a port.
+		var clients []*net.UDPConn
+		var relays []*net.UDPAddr
+
+		for range 4 {
+			client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+			require.NoError(t, err)
+			defer client.Close()
+
+			relay := requestUDPAssociate(t, "127.0.0.1:1180", udpHeader(client.LocalAddr().(*net.UDPAddr))[3:])
+
+			clients = append(clients, client)
+			relays = append(relays, relay)
+		}
+
+		for i, client := range clients {
+			_, err = client.WriteTo(append(udpHeader(destination.LocalAddr().(*net.UDPAddr)), fmt.Sprintf("ping%d", i)...), relays[i])
+			require.NoError(t, err)
+		}
+
+		sources := make(map[string]bool)
+
+		for range clients {
+			destination.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, from, err := destination.ReadFromUDP(buf)
+			require.NoError(t, err)
+
+			// The datagrams are sent from a socket of every association.
+			assert.NotContains(t, []int{1181, 1182, 1191}, from.Port)
+			sources[from.String()] = true
+
+			_, err = destination.WriteToUDP(buf[:n], from)
+			require.NoError(t, err)
+		}
+
+		assert.Len(t, sources, len(clients))
+
+		for i, client := range clients {
+			client.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, err := client.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("ping%d", i), string(buf[10:n]))
+		}
+	})
+}
+
+func TestProxyUDPSharedRelayPendingClientHost(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1192),
+		socks5.WithUDPRelayPorts(1193),
+	)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1197),
+		socks5.WithUDPRelayPorts(1198, 1199),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	// associate sends a UDP ASSOCIATE 0.0.0.0:0 request and returns the reply code.
+	associate := func(t *testing.T, proxyAddress string) byte {
+		conn, err := net.Dial("tcp", proxyAddress)
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		require.NoError(t, err)
+
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+
+		return reply[3]
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		require.Equal(t, byte(socks5.ReplySucceeded), associate(t, "127.0.0.1:1192"))
+
+		// The relay port already waits for a client of the host.
+		assert.Equal(t, byte(socks5.ReplyGeneralFailure), associate(t, "127.0.0.1:1192"))
+	})
+
+	t.Run("another_port", func(t *testing.T) {
+		var clients []*net.UDPConn
+
+		for range 2 {
+			udpConn := associateUDP(t, "127.0.0.1:1197")
+			clients = append(clients, udpConn)
+		}
+
+		assert.NotEqual(t, clients[0].RemoteAddr().String(), clients[1].RemoteAddr().String())
+
+		for i, udpConn := range clients {
+			_, err := udpConn.Write(append(udpHeader(echo), fmt.Sprintf("ping%d", i)...))
+			require.NoError(t, err)
+
+			udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, err := udpConn.Read(buf)
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("ping%d", i), string(buf[10:n]))
+		}
+
+		// Both ports wait for a client of the host.
+		assert.Equal(t, byte(socks5.ReplySucceeded), associate(t, "127.0.0.1:1197"))
+		assert.Equal(t, byte(socks5.ReplySucceeded), associate(t, "127.0.0.1:1197"))
+		assert.Equal(t, byte(socks5.ReplyGeneralFailure), associate(t, "127.0.0.1:1197"))
+	})
+}
+
+func TestProxyUDPOverTCP(t *testing.T) {
+	// request sends a UDPOverTCP request and returns the reply code.
+	request := func(t *testing.T, proxyAddress string) (net.Conn, byte) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		require.NoError(t, err)
+
+		t.Cleanup(func() {
+			conn.Close()
+		})
+
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, byte(socks5.UDPOverTCP), 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		require.NoError(t, err)
+
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+
+		if reply[3] != 0x00 {
+			return conn, reply[3]
+		}
+
+		// Discard the reserved byte and the bound IPv4 address.
+		_, err = io.ReadFull(conn, make([]byte, 8))
+		require.NoError(t, err)
+
+		return conn, reply[3]
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		go runProxy(
+			socks5.WithLogger(socks5.NopLogger),
+			socks5.WithPort(1183),
+			socks5.WithUDPOverTCP(),
+		)
+
+		// Wait for socks5 proxy to start
+		time.Sleep(100 * time.Millisecond)
+
+		conn, code := request(t, "127.0.0.1:1183")
+		require.Equal(t, byte(socks5.ReplySucceeded), code)
+
+		packetConn := socks5.NewUDPOverTCPConn(conn)
+
+		echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+		for _, payload := range []string{"ping", "pong"} {
+			_, err := packetConn.WriteTo([]byte(payload), echo)
+			require.NoError(t, err)
+
+			packetConn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buf := make([]byte, 1024)
+			n, from, err := packetConn.ReadFrom(buf)
+			require.NoError(t, err)
+			assert.Equal(t, payload, string(buf[:n]))
+			assert.Equal(t, echo.String(), from.String())
+		}
+
+		// The replies to a domain name carry the domain name.
+		_, err := packetConn.WriteTo([]byte("ping"), testAddr("localhost:7444"))
+		require.NoError(t, err)
+
+		packetConn.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, from, err := packetConn.ReadFrom(make([]byte, 1024))
+		require.NoError(t, err)
+		assert.Equal(t, "localhost:7444", from.String())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		go runProxy(
+			socks5.WithLogger(socks5.NopLogger),
+			socks5.WithPort(1184),
+		)
+
+		// Wait for socks5 proxy to start
+		time.Sleep(100 * time.Millisecond)
+
+		_, code := request(t, "127.0.0.1:1184")
+		assert.Equal(t, byte(socks5.ReplyCommandNotSupported), code)
+	})
+
+	t.Run("udp_associate_not_allowed", func(t *testing.T) {
+		go runProxy(
+			socks5.WithLogger(socks5.NopLogger),
+			socks5.WithPort(1185),
+			socks5.WithUDPOverTCP(),
+			socks5.WithAllowCommands(socks5.Connect),
+		)
+
+		// Wait for socks5 proxy to start
+		time.Sleep(100 * time.Millisecond)
+
+		_, code := request(t, "127.0.0.1:1185")
+		assert.Equal(t, byte(socks5.ReplyNotAllowedByRuleSet), code)
+	})
+}
+
+func TestProxyUDPStats(t *testing.T) {
+	metrics := socks5.NewPrometheusMetrics()
+
+	srv := socks5.New(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1186),
+		socks5.WithMetrics(metrics),
+		socks5.WithUDPRateLimit(2, 0),
+	)
+
+	go srv.ListenAndServe()
+
+	t.Cleanup(func() {
+		srv.Shutdown()
+	})
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	udpConn := associateUDP(t, "127.0.0.1:1186")
+
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	// The datagrams over the limit of 2 per second are dropped.
+	for i := range 5 {
+		_, err := udpConn.Write(append(udpHeader(echo), fmt.Sprintf("ping%d", i)...))
+		require.NoError(t, err)
+	}
+
+	// A datagram that cannot be decoded.
+	_, err := udpConn.Write([]byte{0x00})
+	require.NoError(t, err)
+
+	var replies int
+
+	for {
+		udpConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+		if _, err := udpConn.Read(make([]byte, 1024)); err != nil {
+			break
+		}
+
+		replies++
+	}
+
+	assert.Equal(t, 2, replies)
+
+	sessions := srv.Sessions()
+	require.Len(t, sessions, 1)
+	require.NotNil(t, sessions[0].UDP)
+
+	assert.Equal(t, socks5.UDPStats{
+		UploadPackets:   2,
+		DownloadPackets: 2,
+		Drops: map[string]int64{
+			socks5.UDPDropRateLimit: 3,
+			socks5.UDPDropDecode:    1,
+		},
+		NatEntries:   1,
+		Destinations: 1,
+	}, *sessions[0].UDP)
+
+	var buff strings.Builder
+	metrics.WriteTo(&buff)
+
+	for _, line := range []string{
+		`socks5_udp_drops_total{reason="rate_limit",user=""} 3`,
+		`socks5_udp_drops_total{reason="decode",user=""} 1`,
+		"socks5_udp_nat_entries 1",
+		"socks5_udp_destinations 1",
+	} {
+		assert.Contains(t, buff.String(), line+"\n")
+	}
+}
+
+func TestProxyUDPDNSInterception(t *testing.T) {
+	resolver, err := socks5.NewCachingResolver(socks5.WithResolverHosts(map[string][]net.IP{
+		"local.test": {net.ParseIP("192.0.2.1")},
+	}))
+	require.NoError(t, err)
+
+	srv := socks5.New(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1187),
+		socks5.WithBlockListHosts("blocked.test"),
+		socks5.WithDNSSinkhole(net.ParseIP("192.0.2.255"), nil),
+		socks5.WithDNSLocalAnswers(),
+		socks5.WithResolver(resolver),
+	)
+
+	go srv.ListenAndServe()
+
+	t.Cleanup(func() {
+		srv.Shutdown()
+	})
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	udpConn := associateUDP(t, "127.0.0.1:1187")
+
+	// No DNS server listens on the destination, the proxy answers the queries.
+	dns := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+
+	testCases := map[string]struct {
+		name   string
+		qtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+		answer dnsmessage.ResourceBody
+	}{
+		"blocked name with sinkhole": {
+			name:   "blocked.test.",
+			qtype:  dnsmessage.TypeA,
+			rcode:  dnsmessage.RCodeSuccess,
+			answer: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 255}},
+		},
+		"blocked name without sinkhole": {
+			name:  "blocked.test.",
+			qtype: dnsmessage.TypeAAAA,
+			rcode: dnsmessage.RCodeNameError,
+		},
+		"blocked name in mixed case": {
+			name:   "BlOcKeD.tEsT.",
+			qtype:  dnsmessage.TypeA,
+			rcode:  dnsmessage.RCodeSuccess,
+			answer: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 255}},
+		},
+		"local answer in mixed case": {
+			name:   "LoCaL.test.",
+			qtype:  dnsmessage.TypeA,
+			rcode:  dnsmessage.RCodeSuccess,
+			answer: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		},
+		"local answer": {
+			name:   "local.test.",
+			qtype:  dnsmessage.TypeA,
+			rcode:  dnsmessage.RCodeSuccess,
+			answer: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			query, err := (&dnsmessage.Message{
+				Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+				Questions: []dnsmessage.Question{{
+					Name:  dnsmessage.MustNewName(tc.name),
+					Type:  tc.qtype,
+					Class: dnsmessage.ClassINET,
+				}},
+			}).Pack()
+			require.NoError(t, err)
+
+			_, err = udpConn.Write(append(udpHeader(dns), query...))
+			require.NoError(t, err)
+
+			udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+			buff := make([]byte, 1024)
+
+			n, err := udpConn.Read(buff)
+			require.NoError(t, err)
+
+			assert.Equal(t, dns.String(), udpHeaderSource(buff[:n]).String())
+
+			var answer dnsmessage.Message
+			require.NoError(t, answer.Unpack(buff[10:n]))
+
+			assert.Equal(t, uint16(42), answer.Header.ID)
+			assert.Equal(t, tc.rcode, answer.Header.RCode)
+
+			if tc.answer == nil {
+				assert.Empty(t, answer.Answers)
+				return
+			}
+
+			require.Len(t, answer.Answers, 1)
+			assert.Equal(t, tc.answer, answer.Answers[0].Body)
+		})
+	}
+}
+
+func TestProxyUDPDNSLocalAnswerAsync(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1200),
+		socks5.WithDNSLocalAnswers(),
+		socks5.WithResolver(delayedResolver{delay: 500 * time.Millisecond, ip: net.ParseIP("192.0.2.1")}),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	udpConn := associateUDP(t, "127.0.0.1:1200")
+
+	dns := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName("slow.test."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+	require.NoError(t, err)
+
+	_, err = udpConn.Write(append(udpHeader(dns), query...))
+	require.NoError(t, err)
+
+	_, err = udpConn.Write(append(udpHeader(echo), "ping"...))
+	require.NoError(t, err)
+
+	buff := make([]byte, 1024)
+
+	// The datagram after the query is relayed while the query is resolved.
+	udpConn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	n, err := udpConn.Read(buff)
+	require.NoError(t, err)
+	assert.Equal(t, echo.String(), udpHeaderSource(buff[:n]).String())
+	assert.Equal(t, "ping", string(buff[10:n]))
+
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, err = udpConn.Read(buff)
+	require.NoError(t, err)
+	assert.Equal(t, dns.String(), udpHeaderSource(buff[:n]).String())
+
+	var answer dnsmessage.Message
+	require.NoError(t, answer.Unpack(buff[10:n]))
+
+	assert.Equal(t, uint16(42), answer.Header.ID)
+	require.Len(t, answer.Answers, 1)
+	assert.Equal(t, &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}, answer.Answers[0].Body)
+}
+
+func TestProxyUDPSourceSelector(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the linux loopback network")
+	}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1190),
+		socks5.WithSourceSelector(socks5.FixedSource(net.ParseIP("127.0.0.2"))),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	// The relay address is the configured host, not the selected source.
+	relay := requestUDPAssociate(t, "127.0.0.1:1190", udpHeader(&net.UDPAddr{IP: net.IPv4zero})[3:])
+	assert.Equal(t, "127.0.0.1", relay.IP.String())
+
+	udpConn, err := net.DialUDP("udp", nil, relay)
+	require.NoError(t, err)
+	defer udpConn.Close()
+
+	echo := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 7444}
+
+	_, err = udpConn.Write(append(udpHeader(echo), "ping"...))
+	require.NoError(t, err)
+
+	udpConn.SetReadDeadline(time.Now().Add(time.Second))
+
+	buff := make([]byte, 1024)
+
+	n, err := udpConn.Read(buff)
+	require.NoError(t, err)
+
+	assert.Equal(t, echo.String(), udpHeaderSource(buff[:n]).String())
+	assert.Equal(t, "ping", string(buff[10:n]))
+}
+
+func TestProxyTracing(t *testing.T) {
+	exporter := &socks5.InMemoryExporter{}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1161),
+		socks5.WithPasswordAuthentication(),
+		socks5.WithTracer(socks5.NewTracer(exporter)),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := newHttpClient("127.0.0.1:1161", &proxy.Auth{
+		User:     "root",
+		Password: "password",
+	})
+	require.NoError(t, err)
+
+	response, err := client.Get("http://127.0.0.1:5444/ping")
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	response.Body.Close()
+	client.CloseIdleConnections()
+
+	var session socks5.SpanData
+
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.Spans() {
+			if span.Name == socks5.SpanSession {
+				session = span
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+
+	children := map[string]socks5.SpanData{}
+
+	for _, span := range exporter.Spans() {
+		if span.ParentSpanID == session.SpanID {
+			assert.Equal(t, session.TraceID, span.TraceID)
+			children[span.Name] = span
+		}
+	}
+
+	for _, name := range []string{
+		socks5.SpanAuthenticate,
+		socks5.SpanRules,
+		socks5.SpanDial,
+		socks5.SpanRelay,
+	} {
+		assert.Containsf(t, children, name, "missing child span %s", name)
+	}
+
+	for key, value := range map[string]any{
+		socks5.AttributeUser:        "root",
+		socks5.AttributeCommand:     "connect",
+		socks5.AttributeDestination: "127.0.0.1:5444",
+		socks5.AttributeReply:       "succeeded",
+	} {
+		actual, ok := session.Attribute(key)
+		require.Truef(t, ok, "missing attribute %s", key)
+		assert.Equal(t, value, actual, key)
+	}
+
+	download, _ := session.Attribute(socks5.AttributeDownloadBytes)
+	assert.Greater(t, download, int64(0))
+}
+
+func TestProxyConnectSniffing(t *testing.T) {
+	driver := &testSniffingDriver{hosts: make(chan string, 1)}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1188),
+		socks5.WithSniffing(0),
+		socks5.WithBlockListHosts("blocked.test"),
+		socks5.WithDriver(driver),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	socks5Dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:1188", nil, proxy.Direct)
+	require.NoError(t, err)
+
+	testCases := map[string]struct {
+		url        string
+		host       string
+		serverName string
+		blocked    bool
+	}{
+		"http_host": {
+			url:  "http://127.0.0.1:5444/ping",
+			host: "allowed.test",
+		},
+		"tls_server_name": {
+			url:        "https://127.0.0.1:6444/ping",
+			serverName: "allowed.test",
+		},
+		"blocked_http_host": {
+			url:     "http://127.0.0.1:5444/ping",
+			host:    "blocked.test",
+			blocked: true,
+		},
+		"blocked_tls_server_name": {
+			url:        "https://127.0.0.1:6444/ping",
+			serverName: "blocked.test",
+			blocked:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &http.Client{
+				Transport: &http.Transport{
+					Dial: socks5Dialer.Dial,
+					TLSClientConfig: &tls.Config{
+						ServerName:         tc.serverName,
+						InsecureSkipVerify: true,
+					},
+					DisableKeepAlives: true,
+				},
+			}
+
+			req, err := http.NewRequest(http.MethodGet, tc.url, nil)
+			require.NoError(t, err)
+
+			req.Host = tc.host
+
+			resp, err := client.Do(req)
+
+			// The rules deny the sniffed name after the success reply,
+			// the proxy closes the connection before dialing.
+			if tc.blocked {
+				require.Error(t, err)
+				assert.Empty(t, driver.hosts)
+				return
+			}
+
+			require.NoError(t, err)
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, "pong!", string(body))
+			assert.Equal(t, "allowed.test", <-driver.hosts)
+		})
+	}
+}
+
+func TestProxyConnectSniffingDialFailure(t *testing.T) {
+	accessLogger := &testAccessLogger{
+		records: make(chan socks5.AccessRecord, 1),
+	}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1194),
+		socks5.WithSniffing(50*time.Millisecond),
+		socks5.WithAccessLogger(accessLogger),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1194")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// CONNECT 127.0.0.1:1, no server listens on the port.
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 1})
+	require.NoError(t, err)
+
+	reply := make([]byte, 2+10)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	// The success reply is sent before the dial.
+	assert.Equal(t, byte(socks5.ReplySucceeded), reply[3])
+
+	// The connection is closed after the failed dial, without another reply.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = conn.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+
+	record := <-accessLogger.records
+
+	assert.Equal(t, byte(socks5.ReplyConnectionRefused), record.Reply)
+	assert.Equal(t, socks5.CloseReasonDialError, record.CloseReason)
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	accessLogger := &testAccessLogger{
+		records: make(chan socks5.AccessRecord, 2),
+	}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1162),
+		socks5.WithAccessLogger(accessLogger),
+		socks5.WithBlockListHosts("www.google.com"),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := newHttpClient("127.0.0.1:1162", nil)
+	require.NoError(t, err)
+
+	response, err := client.Get("http://127.0.0.1:5444/ping")
+	require.NoError(t, err)
+
+	_, err = io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	response.Body.Close()
+	client.CloseIdleConnections()
+
+	record := <-accessLogger.records
+
+	assert.Equal(t, socks5.Connect, record.Command)
+	assert.Equal(t, "127.0.0.1:5444", record.Destination)
+	assert.Equal(t, "127.0.0.1:5444", record.ResolvedDestination)
+	assert.True(t, record.Replied)
+	assert.Equal(t, byte(0x00), record.Reply)
+	assert.Greater(t, record.UploadBytes, int64(0))
+	assert.Greater(t, record.DownloadBytes, int64(0))
+	assert.Equal(t, socks5.CloseReasonCompleted, record.CloseReason)
+
+	_, err = client.Get("http://www.google.com")
+	require.Error(t, err)
+
+	record = <-accessLogger.records
+
+	assert.Equal(t, "www.google.com:80", record.Destination)
+	assert.Equal(t, byte(0x02), record.Reply)
+	assert.Equal(t, socks5.CloseReasonDenied, record.CloseReason)
+}
+
+func TestProxyAccessLogAuthenticationFailure(t *testing.T) {
+	accessLogger := &testAccessLogger{
+		records: make(chan socks5.AccessRecord, 1),
+	}
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1189),
+		socks5.WithAccessLogger(accessLogger),
+		socks5.WithPasswordAuthentication(),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := newHttpClient("127.0.0.1:1189", &proxy.Auth{
+		User:     "root",
+		Password: "wrong",
+	})
+	require.NoError(t, err)
+
+	_, err = client.Get("http://127.0.0.1:5444/ping")
+	require.Error(t, err)
+
+	select {
+	case record := <-accessLogger.records:
+		assert.Equal(t, "root", record.Username)
+		assert.False(t, record.Replied)
+		assert.Equal(t, socks5.CloseReasonDenied, record.CloseReason)
+	case <-time.After(time.Second):
+		t.Fatal("failed authentication was not logged")
+	}
+}
+
+func TestProxyAuthenticationStoreError(t *testing.T) {
+	accessLogger := &testAccessLogger{
+		records: make(chan socks5.AccessRecord, 1),
+	}
+
+	auths := make(chan bool, 1)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1195),
+		socks5.WithAccessLogger(accessLogger),
+		socks5.WithPasswordAuthentication(),
+		socks5.WithStore(failingStore{}),
+		socks5.WithHooks(socks5.Hooks{
+			OnAuth: func(_ context.Context, _ string, _ byte, ok bool) {
+				auths <- ok
+			},
+		}),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1195")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x05, 0x01, 0x02, 0x01, 0x04, 'r', 'o', 'o', 't', 0x01, 'x'})
+	require.NoError(t, err)
+
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	// The store error is answered as a failed authentication.
+	assert.Equal(t, []byte{0x05, 0x02, 0x01, 0x01}, reply)
+	assert.False(t, <-auths)
+
+	record := <-accessLogger.records
+	assert.Equal(t, socks5.CloseReasonDenied, record.CloseReason)
+}
+
+func TestProxySessions(t *testing.T) {
+	srv := socks5.New(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1163),
+	)
+
+	go srv.ListenAndServe()
+
+	t.Cleanup(func() {
+		srv.Shutdown()
+	})
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:1163", nil, proxy.Direct)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", "127.0.0.1:5444")
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	_, err = conn.Write([]byte("GET /ping HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	var session socks5.SessionInfo
+
+	require.Eventually(t, func() bool {
+		sessions := srv.Sessions()
+		if len(sessions) != 1 || sessions[0].Destination == "" {
+			return false
+		}
+
+		session = sessions[0]
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NotEmpty(t, session.ID)
+	assert.Equal(t, socks5.Connect, session.Command)
+	assert.Equal(t, "127.0.0.1:5444", session.Destination)
+	assert.Equal(t, conn.LocalAddr().String(), session.ClientAddress)
+
+	require.Error(t, srv.CloseSession("unknown"))
+	require.NoError(t, srv.CloseSession(session.ID))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, err = io.ReadAll(conn)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(srv.Sessions()) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestProxyHooks(t *testing.T) {
+	events := make(chan string, 10)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1166),
+		socks5.WithPasswordAuthentication(),
+		socks5.WithHooks(socks5.Hooks{
+			OnAccept: func(_ context.Context, _ net.Addr) {
+				events <- "accept"
+				panic("a failing hook must not crash the server")
+			},
+			OnAuth: func(_ context.Context, user string, _ byte, ok bool) {
+				events <- fmt.Sprintf("auth %s %t", user, ok)
+			},
+			OnRequest: func(_ context.Context, cmd socks5.Command, addr string) error {
+				events <- fmt.Sprintf("request %s %s", cmd, addr)
+
+				if addr == "127.0.0.1:6444" {
+					return errors.New("vetoed")
+				}
+
+				return nil
+			},
+			OnDialAttempt: func(_ context.Context, attempt socks5.DialAttempt) {
+				events <- fmt.Sprintf("attempt %s %v", attempt.Address, attempt.Err)
+			},
+			OnDial: func(_ context.Context, addr string, resolved net.Addr, err error) {
+				events <- fmt.Sprintf("dial %s %s %v", addr, resolved, err)
+			},
+			OnClose: func(_ context.Context, stats socks5.AccessRecord) {
+				events <- "close " + stats.CloseReason
+			},
+		}),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	dialer, err := proxy.SOCKS5("tcp", "127.0.0.1:1166", &proxy.Auth{
+		User:     "root",
+		Password: "password",
+	}, proxy.Direct)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", "127.0.0.1:5444")
+	require.NoError(t, err)
+	conn.Close()
+
+	for _, event := range []string{
+		"accept",
+		"auth root true",
+		"request connect 127.0.0.1:5444",
+		"attempt 127.0.0.1:5444 <nil>",
+		"dial 127.0.0.1:5444 127.0.0.1:5444 <nil>",
+		"close completed",
+	} {
+		assert.Equal(t, event, <-events)
+	}
+
+	_, err = dialer.Dial("tcp", "127.0.0.1:6444")
+	require.EqualError(t, err, "socks connect tcp 127.0.0.1:1166->127.0.0.1:6444: "+
+		"unknown error connection not allowed by ruleset")
+
+	for _, event := range []string{
+		"accept",
+		"auth root true",
+		"request connect 127.0.0.1:6444",
+		"close denied",
+	} {
+		assert.Equal(t, event, <-events)
+	}
+}
+
+func TestProxyDialCanceledOnClientClose(t *testing.T) {
+	canceled := make(chan error, 1)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1169),
+		socks5.WithDriver(&testBlockingDriver{canceled: canceled}),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:1169")
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+	require.NoError(t, err)
+
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+
+	// CONNECT 127.0.0.1:5444
+	_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x15, 0x44})
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(time.Second):
+		t.Fatal("dial was not canceled when the client disconnected")
+	}
+}
+
+func TestProxyConnectReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Addr, 2)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	target := l.Addr().(*net.TCPAddr)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1170),
+	)
+
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1171),
+		socks5.WithEchoConnectReply(),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	connect := func(proxyAddress string) (net.IP, int) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+		require.NoError(t, err)
+
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(target.Port >> 8), byte(target.Port)})
+		require.NoError(t, err)
+
+		reply = make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+
+		require.Equal(t, []byte{0x05, 0x00, 0x00, 0x01}, reply[:4])
+
+		return net.IP(reply[4:8]), int(reply[8])<<8 | int(reply[9])
+	}
+
+	// BND.ADDR and BND.PORT are the local address of the outbound connection.
+	ip, port := connect("127.0.0.1:1170")
+	bound := (<-accepted).(*net.TCPAddr)
+
+	assert.True(t, bound.IP.Equal(ip))
+	assert.Equal(t, bound.Port, port)
+
+	// The legacy reply echoes the requested destination.
+	ip, port = connect("127.0.0.1:1171")
+	<-accepted
+
+	assert.True(t, target.IP.Equal(ip))
+	assert.Equal(t, target.Port, port)
+}
+
+func TestProxyMiddleware(t *testing.T) {
+	srv := socks5.New(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1167),
+		socks5.WithBlockListHosts("localhost"),
+	)
+
+	replies := make(chan socks5.ReplyCode, 10)
+
+	srv.Use(
+		// Audit the reply codes
+		func(next socks5.Handler) socks5.Handler {
+			return socks5.HandlerFunc(func(ctx context.Context, req *socks5.Request, w socks5.ReplyWriter) {
+				next.ServeSOCKS(ctx, req, &testReplyWriter{ReplyWriter: w, replies: replies})
+			})
+		},
+		// Deny a port
+		func(next socks5.Handler) socks5.Handler {
+			return socks5.HandlerFunc(func(ctx context.Context, req *socks5.Request, w socks5.ReplyWriter) {
+				if req.Destination == "127.0.0.1:6444" {
+					w.Reply(socks5.ReplyNotAllowedByRuleSet, "")
+					return
+				}
+
+				next.ServeSOCKS(ctx, req, w)
+			})
+		},
+		// Rewrite a destination
+		func(next socks5.Handler) socks5.Handler {
+			return socks5.HandlerFunc(func(ctx context.Context, req *socks5.Request, w socks5.ReplyWriter) {
+				switch req.Destination {
+				case "ping.test:80":
+					req.Destination = "127.0.0.1:5444"
+				case "blocked.test:80":
+					req.Destination = "localhost:5444"
+				}
+
+				next.ServeSOCKS(ctx, req, w)
+			})
+		},
+	)
+
+	go srv.ListenAndServe()
+
+	t.Cleanup(func() {
+		srv.Shutdown()
+	})
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := newHttpClient("127.0.0.1:1167", nil)
+	require.NoError(t, err)
+
+	response, err := client.Get("http://ping.test/ping")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, []byte("pong!"), body)
+	assert.Equal(t, socks5.ReplySucceeded, <-replies)
+
+	_, err = client.Get("http://127.0.0.1:6444")
+	require.EqualError(t, err, "Get \"http://127.0.0.1:6444\": socks connect "+
+		"tcp 127.0.0.1:1167->127.0.0.1:6444: unknown error connection not allowed by ruleset")
+
+	assert.Equal(t, socks5.ReplyNotAllowedByRuleSet, <-replies)
+
+	// The rules are applied to the rewritten destination.
+	_, err = client.Get("http://blocked.test")
+	require.EqualError(t, err, "Get \"http://blocked.test\": socks connect "+
+		"tcp 127.0.0.1:1167->blocked.test:80: unknown error connection not allowed by ruleset")
+
+	assert.Equal(t, socks5.ReplyNotAllowedByRuleSet, <-replies)
+}
+
+func TestProxyCommandHandlers(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1168),
+		socks5.WithResolveCommands(),
+		socks5.WithCommandHandler(0x80, socks5.HandlerFunc(
+			func(_ context.Context, req *socks5.Request, w socks5.ReplyWriter) {
+				w.Reply(socks5.ReplySucceeded, "10.0.0.1:"+req.Destination[len(req.Destination)-2:])
+			},
+		)),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	testCases := map[string]struct {
+		request []byte
+		wait    []byte
+	}{
+		"resolve": {
+			request: []byte{
+				0x05,                                                 // version: 5
+				0xF0,                                                 // command: resolve
+				0x00,                                                 // reserved byte
+				0x03,                                                 // address type: FQDN
+				0x09,                                                 // domain len: 9
+				0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // address: localhost
+				0x00, 0x00, // port: 0
+			},
+			wait: []byte{
+				0x05,                   // version: 5
+				0x00,                   // status: connection successful
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x7F, 0x00, 0x00, 0x01, // address: 127.0.0.1
+				0x00, 0x00, // port: 0
+			},
+		},
+		"resolve_ptr": {
+			request: []byte{
+				0x05,                   // version: 5
+				0xF1,                   // command: resolve_ptr
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x7F, 0x00, 0x00, 0x01, // address: 127.0.0.1
+				0x00, 0x00, // port: 0
+			},
+			wait: []byte{
+				0x05,                                                 // version: 5
+				0x00,                                                 // status: connection successful
+				0x00,                                                 // reserved byte
+				0x03,                                                 // address type: FQDN
+				0x09,                                                 // domain len: 9
+				0x6c, 0x6f, 0x63, 0x61, 0x6c, 0x68, 0x6f, 0x73, 0x74, // address: localhost
+				0x00, 0x00, // port: 0
+			},
+		},
+		"custom_command": {
+			request: []byte{
+				0x05,                   // version: 5
+				0x80,                   // command: custom
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x7F, 0x00, 0x00, 0x01, // address: 127.0.0.1
+				0x00, 0x50, // port: 80
+			},
+			wait: []byte{
+				0x05,                   // version: 5
+				0x00,                   // status: connection successful
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x0A, 0x00, 0x00, 0x01, // address: 10.0.0.1
+				0x00, 0x50, // port: 80
+			},
+		},
+		"not_supported_command": {
+			request: []byte{
+				0x05,                   // version: 5
+				0x81,                   // command: unknown
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x7F, 0x00, 0x00, 0x01, // address: 127.0.0.1
+				0x00, 0x50, // port: 80
+			},
+			wait: []byte{
+				0x05,                   // version: 5
+				0x07,                   // status: command not supported
+				0x00,                   // reserved byte
+				0x01,                   // address type: Ipv4
+				0x7F, 0x00, 0x00, 0x01, // address: 127.0.0.1
+				0x00, 0x50, // port: 80
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", "127.0.0.1:1168")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte{0x05, 0x01, 0x00})
+			require.NoError(t, err)
+
+			response := make([]byte, 2)
+			_, err = io.ReadFull(conn, response)
+			require.NoError(t, err)
+
+			_, err = conn.Write(tc.request)
+			require.NoError(t, err)
+
+			reply := make([]byte, len(tc.wait))
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wait, reply)
+		})
+	}
+}
+
+func TestProxyCommandHandlersAllowCommands(t *testing.T) {
+	go runProxy(
+		socks5.WithLogger(socks5.NopLogger),
+		socks5.WithPort(1196),
+		socks5.WithResolveCommands(),
+		socks5.WithUDPOverTCP(),
+		socks5.WithAllowCommands(socks5.Connect),
+		socks5.WithCommandHandler(0x80, socks5.HandlerFunc(
+			func(_ context.Context, _ *socks5.Request, w socks5.ReplyWriter) {
+				w.Reply(socks5.ReplySucceeded, "")
+			},
+		)),
+	)
+
+	// Wait for socks5 proxy to start
+	time.Sleep(100 * time.Millisecond)
+
+	// The extension and registered commands are denied when not allowed.
+	for _, cmd := range []byte{0xF0, 0xF1, 0xF2, 0x80} {
+		t.Run(fmt.Sprintf("0x%02X", cmd), func(t *testing.T) {
+			conn, err := net.Dial("tcp", "127.0.0.1:1196")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte{0x05, 0x01, 0x00, 0x05, cmd, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+			require.NoError(t, err)
+
+			reply := make([]byte, 4)
+			_, err = io.ReadFull(conn, reply)
+			require.NoError(t, err)
+
+			assert.Equal(t, byte(socks5.ReplyNotAllowedByRuleSet), reply[3])
+		})
+	}
+}
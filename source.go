@@ -0,0 +1,502 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// egressPeerTTL is how long a peer that sent to a UDP relay socket
+	// is answered from it.
+	egressPeerTTL = 5 * time.Minute
+	// egressMaxPeers bounds the peers remembered by a UDP relay socket.
+	egressMaxPeers = 65536
+	// egressQueueSize is the number of received datagrams queued for ReadFrom.
+	egressQueueSize = 64
+	maxDatagramSize = 65535
+)
+
+var errNoSourceAddress = errors.New("no source address of the destination address family")
+
+// SourceSelector picks the local address of the outbound connections and of
+// the datagrams relayed to the UDP destinations by the default Driver. It is
+// asked once per address family of a request, the connection attempts of the
+// request and the datagrams of a UDP association share the picked address.
+type SourceSelector interface {
+	// SelectSource returns the local IP for a connection
+	// to the destination, or nil to let the system choose.
+	SelectSource(ctx context.Context, destination net.IP) (net.IP, error)
+}
+
+type SourceSelectorFunc func(ctx context.Context, destination net.IP) (net.IP, error)
+
+func (f SourceSelectorFunc) SelectSource(ctx context.Context, destination net.IP) (net.IP, error) {
+	return f(ctx, destination)
+}
+
+// FixedSource binds every outbound connection to the IP.
+func FixedSource(ip net.IP) SourceSelector {
+	return &sourcePool{
+		ips: []net.IP{ip},
+		pick: func(_ context.Context, candidates []net.IP) net.IP {
+			return candidates[0]
+		},
+	}
+}
+
+// InterfaceSource binds every outbound connection to the first address
+// of the network interface with the address family of the destination.
+// The addresses are looked up for every connection, so they can change.
+func InterfaceSource(name string) SourceSelector {
+	return SourceSelectorFunc(func(_ context.Context, destination net.IP) (net.IP, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+
+		candidates := sameFamily(ips, destination)
+		if len(candidates) == 0 {
+			return nil, fmt.Errorf("interface %s: %w", name, errNoSourceAddress)
+		}
+
+		return candidates[0], nil
+	})
+}
+
+// RoundRobinSource rotates the outbound connections across the IPs.
+func RoundRobinSource(ips ...net.IP) SourceSelector {
+	var next atomic.Uint64
+
+	return &sourcePool{
+		ips: ips,
+		pick: func(_ context.Context, candidates []net.IP) net.IP {
+			return candidates[(next.Add(1)-1)%uint64(len(candidates))]
+		},
+	}
+}
+
+// RandomSource picks a random IP for every outbound connection.
+func RandomSource(ips ...net.IP) SourceSelector {
+	return &sourcePool{
+		ips: ips,
+		pick: func(_ context.Context, candidates []net.IP) net.IP {
+			return candidates[rand.IntN(len(candidates))]
+		},
+	}
+}
+
+// StickySource picks the same IP for every connection of an authenticated
+// user, or of a client IP when the client did not authenticate.
+func StickySource(ips ...net.IP) SourceSelector {
+	return &sourcePool{
+		ips: ips,
+		pick: func(ctx context.Context, candidates []net.IP) net.IP {
+			key, ok := UsernameFromContext(ctx)
+			if !ok || key == "" {
+				if addr, ok := RemoteAddressFromContext(ctx); ok {
+					key, _, _ = net.SplitHostPort(addr.String())
+				}
+			}
+
+			h := fnv.New64a()
+			h.Write([]byte(key))
+
+			return candidates[h.Sum64()%uint64(len(candidates))]
+		},
+	}
+}
+
+type sourcePool struct {
+	ips  []net.IP
+	pick func(ctx context.Context, candidates []net.IP) net.IP
+}
+
+func (p *sourcePool) SelectSource(ctx context.Context, destination net.IP) (net.IP, error) {
+	candidates := sameFamily(p.ips, destination)
+	if len(candidates) == 0 {
+		return nil, errNoSourceAddress
+	}
+
+	return p.pick(ctx, candidates), nil
+}
+
+// sameFamily returns the IPs of the address family of the destination, or all of them without a destination.
+func sameFamily(ips []net.IP, destination net.IP) []net.IP {
+	if destination == nil {
+		return ips
+	}
+
+	isIPv4 := destination.To4() != nil
+
+	result := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == isIPv4 {
+			result = append(result, ip)
+		}
+	}
+
+	return result
+}
+
+// familySource asks the selector once per address family and keeps the
+// picked address, so the connection attempts of a request and the datagrams
+// of a UDP association leave from the same source.
+type familySource struct {
+	selector SourceSelector
+
+	mutex   sync.Mutex
+	sources map[bool]net.IP
+}
+
+func newFamilySource(selector SourceSelector) *familySource {
+	return &familySource{
+		selector: selector,
+		sources:  make(map[bool]net.IP),
+	}
+}
+
+func (s *familySource) SelectSource(ctx context.Context, destination net.IP) (net.IP, error) {
+	isIPv4 := destination.To4() != nil
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if source, ok := s.sources[isIPv4]; ok {
+		return source, nil
+	}
+
+	source, err := s.selector.SelectSource(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	s.sources[isIPv4] = source
+
+	return source, nil
+}
+
+// sourceDialer binds every connection to the address picked by the selector.
+type sourceDialer struct {
+	dialer   net.Dialer
+	selector SourceSelector
+}
+
+func (d *sourceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.dialer
+
+	if d.selector != nil {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+
+		source, err := d.selector.SelectSource(ctx, net.ParseIP(host))
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+
+		dialer.LocalAddr = localAddr(network, source)
+	}
+
+	return dialer.DialContext(ctx, network, address)
+}
+
+func localAddr(network string, ip net.IP) net.Addr {
+	if ip == nil {
+		return nil
+	}
+
+	switch network {
+	case "udp", "udp4", "udp6":
+		return &net.UDPAddr{IP: ip}
+	default:
+		return &net.TCPAddr{IP: ip}
+	}
+}
+
+// egressPacketConn is a UDP relay socket whose datagrams to the destinations
+// leave from the addresses picked by the source selector, one per address
+// family, on a socket bound to every picked address. The peers that sent to the relay socket, the
+// clients, are answered from it, so the relay address stays the same.
+type egressPacketConn struct {
+	net.PacketConn
+	ctx      context.Context
+	network  string
+	selector SourceSelector
+	packets  chan egressPacket
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex         sync.Mutex
+	peers         map[string]time.Time
+	sockets       map[string]net.PacketConn
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// wake is closed when the read deadline changes.
+	wake chan struct{}
+	now  func() time.Time
+}
+
+type egressPacket struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+func newEgressPacketConn(ctx context.Context, network string, relay net.PacketConn, selector SourceSelector) *egressPacketConn {
+	c := &egressPacketConn{
+		PacketConn: relay,
+		ctx:        ctx,
+		network:    network,
+		selector:   newFamilySource(selector),
+		packets:    make(chan egressPacket, egressQueueSize),
+		closed:     make(chan struct{}),
+		peers:      make(map[string]time.Time),
+		sockets:    make(map[string]net.PacketConn),
+		wake:       make(chan struct{}),
+		now:        time.Now,
+	}
+
+	go c.read(relay, true)
+
+	return c
+}
+
+// read queues the datagrams of a socket until it is closed,
+// the senders to the relay socket are its peers.
+func (c *egressPacketConn) read(conn net.PacketConn, relay bool) {
+	buff := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buff)
+		if err != nil && errors.Is(err, net.ErrClosed) {
+			return
+		}
+
+		packet := egressPacket{addr: addr, err: err}
+
+		if err == nil {
+			packet.data = bytes.Clone(buff[:n])
+
+			if relay {
+				c.addPeer(addr)
+			}
+		}
+
+		select {
+		case c.packets <- packet:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *egressPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		c.mutex.Lock()
+		deadline, wake := c.readDeadline, c.wake
+		c.mutex.Unlock()
+
+		packet, ok := c.receive(deadline, wake)
+		if !ok {
+			continue
+		}
+
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+
+		return copy(p, packet.data), packet.addr, nil
+	}
+}
+
+// receive waits for a datagram until the deadline,
+// it reports false when the deadline changes.
+func (c *egressPacketConn) receive(deadline time.Time, wake <-chan struct{}) (egressPacket, bool) {
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.packets:
+		return packet, true
+	case <-c.closed:
+		return egressPacket{err: c.opError("read", nil, net.ErrClosed)}, true
+	case <-timeout:
+		return egressPacket{err: c.opError("read", nil, os.ErrDeadlineExceeded)}, true
+	case <-wake:
+		return egressPacket{}, false
+	}
+}
+
+// WriteTo sends the datagram to a peer from the relay socket,
+// and to a destination from the address picked for it.
+func (c *egressPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || c.isPeer(addr) {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	conn, err := c.socket(udpAddr.IP)
+	if err != nil {
+		return 0, c.opError("write", addr, err)
+	}
+
+	return conn.WriteTo(p, addr)
+}
+
+// socket returns the socket bound to the source of the destination.
+func (c *egressPacketConn) socket(destination net.IP) (net.PacketConn, error) {
+	source, err := c.selector.SelectSource(c.ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+
+	if source == nil {
+		return c.PacketConn, nil
+	}
+
+	key := source.String()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if conn, ok := c.sockets[key]; ok {
+		return conn, nil
+	}
+
+	select {
+	case <-c.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	var lc net.ListenConfig
+
+	conn, err := lc.ListenPacket(c.ctx, c.network, net.JoinHostPort(key, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(c.writeDeadline)
+
+	c.sockets[key] = conn
+
+	go c.read(conn, false)
+
+	return conn, nil
+}
+
+func (c *egressPacketConn) addPeer(addr net.Addr) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+
+	if _, ok := c.peers[addr.String()]; !ok && len(c.peers) >= egressMaxPeers {
+		for key, seen := range c.peers {
+			if now.Sub(seen) >= egressPeerTTL {
+				delete(c.peers, key)
+			}
+		}
+
+		// Still full: drop an arbitrary peer.
+		for key := range c.peers {
+			if len(c.peers) < egressMaxPeers {
+				break
+			}
+
+			delete(c.peers, key)
+		}
+	}
+
+	c.peers[addr.String()] = now
+}
+
+func (c *egressPacketConn) isPeer(addr net.Addr) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	seen, ok := c.peers[addr.String()]
+
+	return ok && c.now().Sub(seen) < egressPeerTTL
+}
+
+func (c *egressPacketConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *egressPacketConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline = t
+
+	close(c.wake)
+	c.wake = make(chan struct{})
+
+	return nil
+}
+
+func (c *egressPacketConn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+
+	for _, conn := range c.sockets {
+		conn.SetWriteDeadline(t)
+	}
+
+	return c.PacketConn.SetWriteDeadline(t)
+}
+
+func (c *egressPacketConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	errs := []error{c.PacketConn.Close()}
+
+	for key, conn := range c.sockets {
+		errs = append(errs, conn.Close())
+		delete(c.sockets, key)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c *egressPacketConn) opError(op string, addr net.Addr, err error) error {
+	return &net.OpError{Op: op, Net: c.network, Source: c.LocalAddr(), Addr: addr, Err: err}
+}
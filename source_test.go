@@ -0,0 +1,279 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceSelectors(t *testing.T) {
+	pool := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"),
+	}
+
+	ipv4 := net.ParseIP("198.51.100.1")
+	ipv6 := net.ParseIP("2001:db8:1::1")
+
+	ctx := context.Background()
+
+	t.Run("fixed", func(t *testing.T) {
+		ip, err := FixedSource(pool[0]).SelectSource(ctx, ipv4)
+		require.NoError(t, err)
+		assert.Equal(t, pool[0], ip)
+
+		_, err = FixedSource(pool[0]).SelectSource(ctx, ipv6)
+		assert.True(t, errors.Is(err, errNoSourceAddress))
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		selector := RoundRobinSource(pool...)
+
+		var got []net.IP
+		for range 3 {
+			ip, err := selector.SelectSource(ctx, ipv4)
+			require.NoError(t, err)
+
+			got = append(got, ip)
+		}
+
+		assert.Equal(t, []net.IP{pool[0], pool[1], pool[0]}, got)
+
+		ip, err := selector.SelectSource(ctx, ipv6)
+		require.NoError(t, err)
+		assert.Equal(t, pool[2], ip)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		selector := RandomSource(pool...)
+
+		for range 10 {
+			ip, err := selector.SelectSource(ctx, ipv4)
+			require.NoError(t, err)
+			assert.Contains(t, pool[:2], ip)
+		}
+	})
+
+	t.Run("sticky", func(t *testing.T) {
+		selector := StickySource(pool[:2]...)
+
+		alice := contextWithUsername(ctx, "alice")
+
+		first, err := selector.SelectSource(alice, ipv4)
+		require.NoError(t, err)
+
+		for range 5 {
+			ip, err := selector.SelectSource(alice, ipv4)
+			require.NoError(t, err)
+			assert.Equal(t, first, ip)
+		}
+
+		// Without a user the client IP is the key.
+		client := contextWithRemoteAddress(ctx, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 1})
+		other := contextWithRemoteAddress(ctx, &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 2})
+
+		ip, err := selector.SelectSource(client, ipv4)
+		require.NoError(t, err)
+
+		same, err := selector.SelectSource(other, ipv4)
+		require.NoError(t, err)
+		assert.Equal(t, ip, same)
+	})
+
+	t.Run("interface", func(t *testing.T) {
+		loopback := loopbackInterface(t)
+
+		ip, err := InterfaceSource(loopback).SelectSource(ctx, ipv4)
+		require.NoError(t, err)
+		assert.True(t, ip.IsLoopback())
+
+		_, err = InterfaceSource("no-such-interface").SelectSource(ctx, ipv4)
+		assert.Error(t, err)
+	})
+}
+
+func loopbackInterface(t *testing.T) string {
+	t.Helper()
+
+	ifaces, err := net.Interfaces()
+	require.NoError(t, err)
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Name
+		}
+	}
+
+	t.Skip("no loopback interface")
+
+	return ""
+}
+
+func TestNetDriverSourceAddress(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the linux loopback network")
+	}
+
+	source := net.ParseIP("127.0.0.2")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Addr, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		accepted <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	d := &netDriver{
+		attemptDelay: defaultDialAttemptDelay,
+		resolver:     &systemResolver{},
+		selector:     FixedSource(source),
+	}
+
+	conn, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	assert.True(t, source.Equal((<-accepted).(*net.TCPAddr).IP))
+
+	// The relay socket keeps its address, the clients are answered from it
+	// and the datagrams to the destinations leave from the selected source.
+	packetConn, err := d.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	relay := packetConn.LocalAddr().(*net.UDPAddr)
+	assert.Equal(t, "127.0.0.1", relay.IP.String())
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer client.Close()
+
+	destination, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer destination.Close()
+
+	buff := make([]byte, 64)
+
+	_, err = client.WriteTo([]byte("request"), relay)
+	require.NoError(t, err)
+
+	n, from, err := packetConn.ReadFrom(buff)
+	require.NoError(t, err)
+	assert.Equal(t, "request", string(buff[:n]))
+	assert.Equal(t, client.LocalAddr().String(), from.String())
+
+	_, err = packetConn.WriteTo([]byte("request"), destination.LocalAddr())
+	require.NoError(t, err)
+
+	destination.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, egress, err := destination.ReadFromUDP(buff)
+	require.NoError(t, err)
+	assert.True(t, source.Equal(egress.IP))
+
+	_, err = destination.WriteToUDP([]byte("reply"), egress)
+	require.NoError(t, err)
+
+	n, from, err = packetConn.ReadFrom(buff)
+	require.NoError(t, err)
+	assert.Equal(t, "reply", string(buff[:n]))
+	assert.Equal(t, destination.LocalAddr().String(), from.String())
+
+	_, err = packetConn.WriteTo([]byte("reply"), client.LocalAddr())
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+
+	_, replied, err := client.ReadFromUDP(buff)
+	require.NoError(t, err)
+	assert.Equal(t, relay.String(), replied.String())
+
+	// A destination without a source of its family is not dialed.
+	d.selector = FixedSource(net.ParseIP("::1"))
+
+	_, err = d.Dial("tcp", l.Addr().String())
+	assert.True(t, errors.Is(err, errNoSourceAddress))
+}
+
+func TestFamilySource(t *testing.T) {
+	var calls int
+
+	selector := newFamilySource(SourceSelectorFunc(func(ctx context.Context, destination net.IP) (net.IP, error) {
+		calls++
+
+		return RoundRobinSource(
+			net.ParseIP("192.0.2.1"),
+			net.ParseIP("2001:db8::1"),
+		).SelectSource(ctx, destination)
+	}))
+
+	ctx := context.Background()
+
+	for range 3 {
+		ip, err := selector.SelectSource(ctx, net.ParseIP("198.51.100.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "192.0.2.1", ip.String())
+
+		ip, err = selector.SelectSource(ctx, net.ParseIP("2001:db8:1::1"))
+		require.NoError(t, err)
+		assert.Equal(t, "2001:db8::1", ip.String())
+	}
+
+	assert.Equal(t, 2, calls)
+}
+
+func TestNetDriverRoundRobinSourceSticks(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("binding to 127.0.0.2 requires the linux loopback network")
+	}
+
+	d := &netDriver{
+		attemptDelay: defaultDialAttemptDelay,
+		resolver:     &systemResolver{},
+		selector:     RoundRobinSource(net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3")),
+	}
+
+	packetConn, err := d.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	destination, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer destination.Close()
+
+	buff := make([]byte, 64)
+
+	var first *net.UDPAddr
+
+	for range 4 {
+		_, err = packetConn.WriteTo([]byte("request"), destination.LocalAddr())
+		require.NoError(t, err)
+
+		destination.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, egress, err := destination.ReadFromUDP(buff)
+		require.NoError(t, err)
+
+		if first == nil {
+			first = egress
+		}
+
+		assert.Equal(t, first.String(), egress.String())
+	}
+}
@@ -0,0 +1,210 @@
+package socks5
+
+import (
+	"context"
+	"encoding/hex"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Names of the spans created for every proxied session.
+const (
+	SpanSession      = "socks5.session"
+	SpanAuthenticate = "socks5.authenticate"
+	SpanRules        = "socks5.rules"
+	SpanDial         = "socks5.dial"
+	SpanResolve      = "socks5.resolve"
+	SpanRelay        = "socks5.relay"
+)
+
+// Keys of the attributes recorded on the spans.
+const (
+	AttributeSessionID     = "socks5.session_id"
+	AttributeClient        = "socks5.client"
+	AttributeUser          = "socks5.user"
+	AttributeCommand       = "socks5.command"
+	AttributeDestination   = "socks5.destination"
+	AttributeResolved      = "socks5.resolved"
+	AttributeDialAttempts  = "socks5.dial_attempts"
+	AttributeReply         = "socks5.reply"
+	AttributeUploadBytes   = "socks5.upload_bytes"
+	AttributeDownloadBytes = "socks5.download_bytes"
+	AttributeSniffedHost   = "socks5.sniffed_host"
+)
+
+// Tracer starts the spans of a session. It can be backed by OpenTelemetry or
+// any other tracing system, the default tracer does nothing.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// SpanExporter receives the spans finished by the tracer returned by NewTracer.
+type SpanExporter interface {
+	ExportSpan(ctx context.Context, span SpanData)
+}
+
+type SpanData struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   []Attribute
+	Errors       []error
+}
+
+// Attribute returns the value of the last attribute with the given key.
+func (d SpanData) Attribute(key string) (any, bool) {
+	for i := len(d.Attributes) - 1; i >= 0; i-- {
+		if d.Attributes[i].Key == key {
+			return d.Attributes[i].Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// NewTracer returns a tracer that passes every finished span to the exporter.
+func NewTracer(exporter SpanExporter) Tracer {
+	return &exportTracer{exporter: exporter}
+}
+
+type exportTracer struct {
+	exporter SpanExporter
+}
+
+func (t *exportTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &exportSpan{
+		ctx:      ctx,
+		exporter: t.exporter,
+		data: SpanData{
+			TraceID:   newTraceID(16),
+			SpanID:    newTraceID(8),
+			Name:      name,
+			StartTime: time.Now(),
+		},
+	}
+
+	if parent, ok := ctx.Value(spanKey).(*exportSpan); ok {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentSpanID = parent.data.SpanID
+	}
+
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+type exportSpan struct {
+	mutex    sync.Mutex
+	ctx      context.Context
+	exporter SpanExporter
+	data     SpanData
+	ended    bool
+}
+
+func (s *exportSpan) SetAttributes(attrs ...Attribute) {
+	s.mutex.Lock()
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+	s.mutex.Unlock()
+}
+
+func (s *exportSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	s.data.Errors = append(s.data.Errors, err)
+	s.mutex.Unlock()
+}
+
+func (s *exportSpan) End() {
+	s.mutex.Lock()
+
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+
+	s.ended = true
+	s.data.EndTime = time.Now()
+	data := s.data
+
+	s.mutex.Unlock()
+
+	s.exporter.ExportSpan(s.ctx, data)
+}
+
+func newTraceID(size int) string {
+	id := make([]byte, size)
+
+	for i := range id {
+		id[i] = byte(rand.Uint32())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// InMemoryExporter keeps the finished spans in memory, it is intended for tests.
+type InMemoryExporter struct {
+	mutex sync.Mutex
+	spans []SpanData
+}
+
+func (e *InMemoryExporter) ExportSpan(_ context.Context, span SpanData) {
+	e.mutex.Lock()
+	e.spans = append(e.spans, span)
+	e.mutex.Unlock()
+}
+
+// Spans returns a copy of the finished spans in the order they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return append([]SpanData(nil), e.spans...)
+}
+
+func (e *InMemoryExporter) Reset() {
+	e.mutex.Lock()
+	e.spans = nil
+	e.mutex.Unlock()
+}
+
+type nopTracer struct{}
+
+func (t *nopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(_ ...Attribute) {}
+func (nopSpan) RecordError(_ error)          {}
+func (nopSpan) End()                         {}
+
+// sessionSpanFromContext returns the span of the session the context
+// belongs to, so that attributes can be recorded on it at any stage.
+func sessionSpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(sessionSpanKey).(Span); ok {
+		return span
+	}
+
+	return nopSpan{}
+}
+
+func contextWithSessionSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, sessionSpanKey, span)
+}
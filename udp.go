@@ -0,0 +1,604 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpReadRetryDelay is the delay before a read is retried after an
+	// error, it doubles with every consecutive error up to udpMaxReadRetryDelay.
+	udpReadRetryDelay    = 5 * time.Millisecond
+	udpMaxReadRetryDelay = time.Second
+	// udpMaxReadErrors is the number of consecutive read errors
+	// after which an association ends.
+	udpMaxReadErrors = 10
+)
+
+// Filtering behaviors of a UDP association for the datagrams sent
+// by remote hosts to the relay, RFC 4787 section 5.
+const (
+	// AddressAndPortDependentFiltering forwards the datagrams from the
+	// addresses and ports the client has sent datagrams to.
+	AddressAndPortDependentFiltering UDPFiltering = iota
+	// AddressDependentFiltering forwards the datagrams from any port
+	// of the hosts the client has sent datagrams to.
+	AddressDependentFiltering
+	// EndpointIndependentFiltering forwards the datagrams from any host,
+	// also known as full cone NAT.
+	EndpointIndependentFiltering
+)
+
+type UDPFiltering int
+
+func (f UDPFiltering) String() string {
+	switch f {
+	case AddressDependentFiltering:
+		return "address_dependent"
+	case EndpointIndependentFiltering:
+		return "endpoint_independent"
+	default:
+		return "address_and_port_dependent"
+	}
+}
+
+// udpAssociation relays the datagrams of a UDP ASSOCIATE request
+// between the client and the remote hosts.
+type udpAssociation struct {
+	server *Server
+	ctx    context.Context
+	sess   *session
+	conn   *connection
+	// packetConn is the socket of the association, the datagrams
+	// are sent to the remote hosts and received from them on it.
+	packetConn net.PacketConn
+	// relayConn is the socket the client sends datagrams to, packetConn
+	// unless the association is on a shared relay.
+	relayConn net.PacketConn
+	// requests are the datagrams of the client received by another
+	// goroutine, on a shared relay or over the control connection.
+	requests chan []byte
+	nat      *natTable
+	// reassembler is nil when fragmentation is disabled.
+	reassembler *reassembler
+	// mtu is the largest datagram sent to the client, zero when
+	// the replies are not fragmented.
+	mtu int
+	// declared is the address the client declared in the request,
+	// nil when the client sent zeros.
+	declared *net.UDPAddr
+	// client is the address the client sends datagrams from, the first
+	// datagram that matches the declared address sets it.
+	client atomic.Pointer[net.UDPAddr]
+	stats  *udpStats
+	// packetLimit and byteLimit cap the datagrams of the client,
+	// they are nil without a limit.
+	packetLimit *tokenBucket
+	byteLimit   *tokenBucket
+	// dnsQueries holds a slot for every query answered with the Resolver.
+	dnsQueries chan struct{}
+}
+
+func (s *Server) newUDPAssociation(ctx context.Context, conn *connection, packetConn net.PacketConn) *udpAssociation {
+	a := &udpAssociation{
+		server:     s,
+		ctx:        ctx,
+		sess:       sessionFromContext(ctx),
+		conn:       conn,
+		packetConn: packetConn,
+		relayConn:  packetConn,
+		nat:        s.nat.newTable(),
+	}
+
+	a.stats = &udpStats{nat: a.nat}
+
+	if s.config.dnsLocalAnswers {
+		a.dnsQueries = make(chan struct{}, dnsMaxLocalQueries)
+	}
+
+	a.nat.onChange = func(entries, hosts int) {
+		s.udpMetrics.UDPNatEntries(ctx, entries)
+		s.udpMetrics.UDPDestinations(ctx, hosts)
+	}
+
+	a.nat.onEvict = func(reason string) {
+		a.stats.evictions.Add(1)
+		s.natMetrics.UDPNatEviction(ctx, reason)
+	}
+	a.sess.setUDPStats(a.stats)
+
+	if s.config.udpPacketRate > 0 {
+		a.packetLimit = newTokenBucket(s.config.udpPacketRate)
+	}
+
+	if s.config.udpByteRate > 0 {
+		a.byteLimit = newTokenBucket(s.config.udpByteRate)
+	}
+
+	return a
+}
+
+func (s *Server) udpAssociate(ctx context.Context, conn *connection, w ReplyWriter, addr *address) {
+	sess := sessionFromContext(ctx)
+
+	declared, err := s.declaredClient(ctx, addr)
+	if err != nil {
+		sess.close(CloseReasonDialError)
+
+		w.Reply(replyCodeFromError(err), "")
+
+		s.logger.Error(ctx, "failed to resolve client UDP address", LogKeyError, err)
+		return
+	}
+
+	// A client that sent zeros gets a relay on the port it asked for,
+	// the socket of an association on a shared relay is only for the remote hosts.
+	listenPort := addr.Port.String()
+	if declared != nil || s.udpRelay != nil {
+		listenPort = "0"
+	}
+
+	packetConn, err := s.listenPacket(ctx, "udp", net.JoinHostPort(s.config.host, listenPort))
+	if err != nil {
+		sess.close(CloseReasonListenError)
+
+		w.Reply(replyCodeFromError(err), "")
+
+		s.logger.Error(ctx, "error listen udp", LogKeyError, err)
+		return
+	}
+
+	association := s.newUDPAssociation(ctx, conn, packetConn)
+	association.declared = declared
+
+	if s.udpRelay != nil {
+		association.requests = make(chan []byte, udpRequestQueueSize)
+
+		association.relayConn, err = s.udpRelay.register(association)
+		if err != nil {
+			packetConn.Close()
+
+			sess.close(CloseReasonListenError)
+
+			w.Reply(replyCodeFromError(err), "")
+
+			s.logger.Error(ctx, "error register udp association", LogKeyError, err)
+			return
+		}
+	}
+
+	conn.onClose(func() {
+		if s.udpRelay != nil {
+			s.udpRelay.unregister(association)
+		}
+
+		if err := packetConn.Close(); err != nil {
+			s.logger.Error(ctx, "error close udp listener", LogKeyError, err)
+		}
+	})
+
+	go conn.keepAlive()
+
+	w.Reply(ReplySucceeded, s.relayAddress(conn, association.relayConn))
+
+	association.relay(s.config.udpMTU)
+}
+
+// relay forwards the datagrams until the control connection is closed,
+// the replies larger than the mtu are fragmented.
+func (a *udpAssociation) relay(mtu int) {
+	s := a.server
+
+	a.mtu = mtu
+
+	if s.config.udpMTU > 0 {
+		a.reassembler = newReassembler()
+	}
+
+	_, span := s.tracer.Start(a.ctx, SpanRelay)
+	defer span.End()
+
+	s.logger.Info(a.ctx, "start of udp datagram forwarding")
+
+	err := a.serve()
+
+	a.nat.clear()
+
+	s.recordRelay(a.ctx, span, a.sess.upload.Load(), a.sess.download.Load(), err)
+
+	if err != nil {
+		a.sess.close(CloseReasonRelayError)
+
+		s.logger.Error(a.ctx, "udp datagram forwarding failed", LogKeyError, err)
+	}
+
+	a.sess.close(CloseReasonCompleted)
+
+	s.logger.Info(a.ctx, "udp datagram forwarding complete")
+}
+
+// serve reads the datagrams of the association until the control connection
+// is closed, it returns the error that repeated on every read.
+func (a *udpAssociation) serve() error {
+	if a.requests != nil {
+		go a.serveRequests()
+	}
+
+	buff := a.server.bytePool.get()
+	defer a.server.bytePool.put(buff)
+
+	var backoff readBackoff
+
+	for a.conn.isActive() {
+		n, from, err := a.packetConn.ReadFrom(buff)
+		if err != nil {
+			if isClosedListenerError(err) {
+				return nil
+			}
+
+			a.drop(UDPDropRead)
+
+			a.server.logger.Error(a.ctx, "failed to read from packet connection", LogKeyError, err)
+
+			if backoff.errors++; backoff.errors >= udpMaxReadErrors {
+				return err
+			}
+
+			if !backoff.wait(a.conn.done) {
+				return nil
+			}
+
+			continue
+		}
+
+		backoff.reset()
+
+		if client, source, ok := a.nat.get(from); ok {
+			a.forwardReply(client, source, from, buff[:n])
+			continue
+		}
+
+		if a.requests == nil && a.isClient(from) {
+			a.forwardRequest(from, buff[:n])
+			continue
+		}
+
+		a.forwardUnsolicited(from, buff[:n])
+	}
+
+	return nil
+}
+
+// readBackoff delays the reads retried after consecutive errors,
+// so that a persistent error does not spin the read loop.
+type readBackoff struct {
+	delay time.Duration
+	// errors counts the consecutive errors.
+	errors int
+}
+
+// wait sleeps before the next read, it reports false when done is closed first.
+func (b *readBackoff) wait(done <-chan struct{}) bool {
+	b.delay = min(max(2*b.delay, udpReadRetryDelay), udpMaxReadRetryDelay)
+
+	timer := time.NewTimer(b.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (b *readBackoff) reset() {
+	b.delay = 0
+	b.errors = 0
+}
+
+// serveRequests forwards the queued datagrams of the client.
+func (a *udpAssociation) serveRequests() {
+	for {
+		select {
+		case data := <-a.requests:
+			a.forwardRequest(a.client.Load(), data)
+		case <-a.conn.done:
+			return
+		}
+	}
+}
+
+// enqueue queues a datagram of the client received on the shared relay.
+func (a *udpAssociation) enqueue(data []byte) {
+	select {
+	case a.requests <- append([]byte(nil), data...):
+	default:
+		a.drop(UDPDropQueueFull)
+	}
+}
+
+// drop counts a datagram dropped for the reason.
+func (a *udpAssociation) drop(reason string) {
+	a.stats.drop(reason)
+	a.server.udpMetrics.UDPDrop(a.ctx, reason)
+}
+
+// allow reports whether the datagram of the client is within the rate limits.
+func (a *udpAssociation) allow(p *packet) bool {
+	if a.packetLimit != nil && !a.packetLimit.allow(1) {
+		return false
+	}
+
+	return a.byteLimit == nil || a.byteLimit.allow(len(p.payload))
+}
+
+// declaredClient returns the address the client will send datagrams from,
+// or nil when the client does not know it and sent zeros, RFC 1928 section 6.
+func (s *Server) declaredClient(ctx context.Context, addr *address) (*net.UDPAddr, error) {
+	if addr.IP != nil && addr.IP.IsUnspecified() {
+		return nil, nil
+	}
+
+	resolved, err := s.resolve(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	declared, ok := resolved.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unexpected address type %T", resolved)
+	}
+
+	return declared, nil
+}
+
+// relayAddress returns the BND.ADDR and BND.PORT of the relay. The public IP
+// is replaced by an IPv6 address of the relay when the relay listens on IPv6
+// or the client reached the server over IPv6, so IPv6 clients can use it.
+func (s *Server) relayAddress(conn *connection, packetConn net.PacketConn) string {
+	ip := s.config.publicIP
+	port := 0
+
+	if local, ok := packetConn.LocalAddr().(*net.UDPAddr); ok {
+		port = local.Port
+
+		if ip.To4() != nil {
+			switch control, _ := conn.LocalAddr().(*net.TCPAddr); {
+			case local.IP.To4() == nil && !local.IP.IsUnspecified():
+				ip = local.IP
+			case local.IP.IsUnspecified() && control != nil && control.IP.To4() == nil:
+				ip = control.IP
+			}
+		}
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// isClient reports whether the datagram comes from the client. Without
+// a declared address the first datagram from the host of the control
+// connection sets the client address, and a declared port of zero
+// is set by the first datagram from the declared IP.
+func (a *udpAssociation) isClient(from net.Addr) bool {
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	if client := a.client.Load(); client != nil {
+		return client.IP.Equal(addr.IP) && client.Port == addr.Port
+	}
+
+	if !a.matchesClient(addr) {
+		return false
+	}
+
+	a.client.Store(addr)
+
+	return true
+}
+
+// matchesClient reports whether the address can be the client
+// of the association before the client address is set.
+func (a *udpAssociation) matchesClient(addr *net.UDPAddr) bool {
+	switch {
+	case a.declared == nil:
+		return a.conn.equalAddresses(addr)
+	case !a.declared.IP.Equal(addr.IP):
+		return false
+	case a.declared.Port != 0 && a.declared.Port != addr.Port:
+		return false
+	}
+
+	return true
+}
+
+// clientHost returns the IP the client sends datagrams from, the declared IP
+// or the host of the control connection when the client sent zeros.
+func (a *udpAssociation) clientHost() net.IP {
+	if a.declared != nil {
+		return a.declared.IP
+	}
+
+	host, _, err := net.SplitHostPort(a.conn.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// forwardRequest sends a datagram of the client to its destination.
+func (a *udpAssociation) forwardRequest(from net.Addr, data []byte) {
+	s := a.server
+
+	var packet packet
+
+	if err := packet.decode(data); err != nil {
+		a.drop(UDPDropDecode)
+
+		s.logger.Error(a.ctx, "failed to unpack packet", LogKeyError, err)
+		return
+	}
+
+	datagram, ok := a.reassemble(&packet)
+	if !ok {
+		return
+	}
+
+	packet = *datagram
+
+	if !a.allow(&packet) {
+		a.drop(UDPDropRateLimit)
+		return
+	}
+
+	if !s.policy.Load().rules.IsAllowDestination(a.ctx, packet.address.getDomainOrIP()) {
+		a.drop(UDPDropRule)
+
+		s.metrics.RuleDenial(a.ctx)
+		return
+	}
+
+	if a.interceptDNS(from, &packet) {
+		return
+	}
+
+	destAddress, err := s.resolve(a.ctx, "udp", packet.address)
+	if err != nil {
+		a.drop(UDPDropResolve)
+
+		s.logger.Error(a.ctx, "failed to resolve target UDP address",
+			LogKeyDestination, packet.address.String(),
+			LogKeyError, err,
+		)
+		return
+	}
+
+	// The mapping is set first, the reply can be read by
+	// another goroutine before the write returns.
+	a.nat.set(from, destAddress, packet.address)
+
+	a.packetConn.SetWriteDeadline(newDeadline(s.config.packetWriteTimeout))
+	if _, err := a.packetConn.WriteTo(packet.payload, destAddress); err != nil {
+		a.drop(UDPDropWrite)
+
+		if !isClosedListenerError(err) {
+			s.logger.Error(a.ctx, "failed writing to packet connection", LogKeyError, err)
+		}
+		return
+	}
+
+	s.metrics.UploadBytes(a.ctx, packet.payload.len())
+	a.sess.upload.Add(packet.payload.len())
+	a.stats.upload.Add(1)
+	s.metrics.UploadPacket(a.ctx)
+}
+
+// forwardUnsolicited forwards a datagram from a host without
+// a mapping when the filtering behavior allows it.
+func (a *udpAssociation) forwardUnsolicited(from net.Addr, data []byte) {
+	switch a.server.config.udpFiltering {
+	case EndpointIndependentFiltering:
+	case AddressDependentFiltering:
+		if !a.nat.hasHost(from) {
+			a.drop(UDPDropFiltered)
+			return
+		}
+	default:
+		a.drop(UDPDropFiltered)
+		return
+	}
+
+	client := a.client.Load()
+	if client == nil {
+		return
+	}
+
+	source, err := addressFromNetAddr(from)
+	if err != nil {
+		return
+	}
+
+	a.forwardReply(client, source, from, data)
+}
+
+// forwardReply sends a datagram of a remote host to the client with
+// the source address in the header, RFC 1928 section 7.
+func (a *udpAssociation) forwardReply(client net.Addr, source *address, from net.Addr, data []byte) {
+	s := a.server
+
+	if host, _, err := net.SplitHostPort(from.String()); err != nil ||
+		!s.policy.Load().rules.IsAllowDestination(a.ctx, host) {
+		a.drop(UDPDropRule)
+
+		s.metrics.RuleDenial(a.ctx)
+		return
+	}
+
+	a.sendReply(client, source, data)
+}
+
+// sendReply sends a datagram to the client with the source address in the header.
+func (a *udpAssociation) sendReply(client net.Addr, source *address, data []byte) {
+	s := a.server
+
+	datagrams, err := fragment(source, data, a.mtu)
+	if err != nil {
+		a.drop(UDPDropFragment)
+
+		s.logger.Error(a.ctx, "failed to fragment packet", LogKeyError, err)
+		return
+	}
+
+	for _, datagram := range datagrams {
+		a.relayConn.SetWriteDeadline(newDeadline(s.config.packetWriteTimeout))
+		if _, err := a.relayConn.WriteTo(datagram, client); err != nil {
+			a.drop(UDPDropWrite)
+
+			if !isClosedListenerError(err) {
+				s.logger.Error(a.ctx, "failed writing to packet connection", LogKeyError, err)
+			}
+			return
+		}
+	}
+
+	s.metrics.DownloadBytes(a.ctx, int64(len(data)))
+	a.sess.download.Add(int64(len(data)))
+	a.stats.download.Add(1)
+	s.metrics.DownloadPacket(a.ctx)
+}
+
+// reassemble returns the datagram to forward: a standalone datagram,
+// or the reassembled datagram once the last fragment has arrived.
+func (a *udpAssociation) reassemble(p *packet) (*packet, bool) {
+	if p.frag == 0 {
+		if a.reassembler != nil {
+			a.reassembler.reset()
+		}
+
+		return p, true
+	}
+
+	// Without fragmentation every fragment must be dropped.
+	if a.reassembler == nil {
+		a.drop(UDPDropFragment)
+
+		a.server.logger.Warn(a.ctx, "fragment dropped", LogKeyError, errFragmentationOff)
+		return nil, false
+	}
+
+	datagram, err := a.reassembler.add(p)
+	if err != nil {
+		a.drop(UDPDropFragment)
+
+		a.server.logger.Warn(a.ctx, "fragments dropped", LogKeyError, err)
+	}
+
+	return datagram, datagram != nil
+}
@@ -0,0 +1,217 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// udpRequestQueueSize is the number of datagrams of a client
+// queued on a shared relay, the next ones are dropped.
+const udpRequestQueueSize = 64
+
+var (
+	errClientAddressInUse = errors.New("client address is bound to another association")
+	errClientHostPending  = errors.New("every relay port has a pending association of the client host")
+)
+
+// udpRelay is the set of UDP sockets shared by the associations when the relay
+// ports are configured. The datagrams of the clients are demultiplexed by the
+// client address, and every client address is bound to a single association,
+// so to the control connection and the user of that association. The datagrams
+// to the remote hosts are sent from the socket of the association.
+type udpRelay struct {
+	server *Server
+	conns  []net.PacketConn
+	next   atomic.Uint64
+
+	mutex   sync.RWMutex
+	clients map[string]*udpAssociation
+	// pending are the associations that learn the client
+	// address from the first datagram, by relay socket.
+	pending map[net.PacketConn][]*udpAssociation
+}
+
+func (s *Server) listenUDPRelay(ctx context.Context) (*udpRelay, error) {
+	r := &udpRelay{
+		server:  s,
+		clients: make(map[string]*udpAssociation),
+		pending: make(map[net.PacketConn][]*udpAssociation),
+	}
+
+	for _, port := range s.config.udpRelayPorts {
+		conn, err := s.listenPacket(ctx, "udp", net.JoinHostPort(s.config.host, strconv.Itoa(port)))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+
+		r.conns = append(r.conns, conn)
+	}
+
+	for _, conn := range r.conns {
+		go r.serve(ctx, conn)
+	}
+
+	return r, nil
+}
+
+func (r *udpRelay) close() error {
+	var errs []error
+
+	for _, conn := range r.conns {
+		errs = append(errs, conn.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+// register assigns a relay socket to the association. An association that
+// learns the client address from the first datagram gets a relay socket
+// without a pending association of the same client host, as the first
+// datagram could not tell them apart.
+func (r *udpRelay) register(a *udpAssociation) (net.PacketConn, error) {
+	next := r.next.Add(1) - 1
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if a.declared == nil || a.declared.Port == 0 {
+		host := a.clientHost()
+
+		for i := range uint64(len(r.conns)) {
+			conn := r.conns[(next+i)%uint64(len(r.conns))]
+
+			if r.hasPending(conn, host) {
+				continue
+			}
+
+			r.pending[conn] = append(r.pending[conn], a)
+			return conn, nil
+		}
+
+		return nil, errClientHostPending
+	}
+
+	conn := r.conns[next%uint64(len(r.conns))]
+
+	key := a.declared.String()
+	if _, ok := r.clients[key]; ok {
+		return nil, errClientAddressInUse
+	}
+
+	r.clients[key] = a
+	a.client.Store(a.declared)
+
+	return conn, nil
+}
+
+// hasPending reports whether a pending association of the relay socket
+// accepts the datagrams from the host.
+func (r *udpRelay) hasPending(conn net.PacketConn, host net.IP) bool {
+	for _, p := range r.pending[conn] {
+		if p.clientHost().Equal(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *udpRelay) unregister(a *udpAssociation) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if client := a.client.Load(); client != nil && r.clients[client.String()] == a {
+		delete(r.clients, client.String())
+	}
+
+	pending := r.pending[a.relayConn]
+	for i, p := range pending {
+		if p == a {
+			r.pending[a.relayConn] = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+
+	if len(r.pending[a.relayConn]) == 0 {
+		delete(r.pending, a.relayConn)
+	}
+}
+
+// lookup returns the association of the client address. A client address
+// without an association is bound to the pending association of the relay
+// socket that accepts it, register keeps a single one per client host.
+func (r *udpRelay) lookup(conn net.PacketConn, from net.Addr) *udpAssociation {
+	key := from.String()
+
+	r.mutex.RLock()
+	a, ok := r.clients[key]
+	r.mutex.RUnlock()
+
+	if ok {
+		return a
+	}
+
+	addr, ok := from.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if a, ok := r.clients[key]; ok {
+		return a
+	}
+
+	pending := r.pending[conn]
+	for i, a := range pending {
+		if !a.matchesClient(addr) {
+			continue
+		}
+
+		a.client.Store(addr)
+
+		r.clients[key] = a
+		r.pending[conn] = append(pending[:i:i], pending[i+1:]...)
+
+		return a
+	}
+
+	return nil
+}
+
+func (r *udpRelay) serve(ctx context.Context, conn net.PacketConn) {
+	buff := r.server.bytePool.get()
+	defer r.server.bytePool.put(buff)
+
+	// The relay socket is shared, the reads are retried until it is closed.
+	var backoff readBackoff
+
+	for {
+		n, from, err := conn.ReadFrom(buff)
+		if err != nil {
+			if isClosedListenerError(err) {
+				return
+			}
+
+			r.server.logger.Error(ctx, "failed to read from packet connection", LogKeyError, err)
+
+			if !backoff.wait(r.server.active) {
+				return
+			}
+
+			continue
+		}
+
+		backoff.reset()
+
+		if a := r.lookup(conn, from); a != nil {
+			a.enqueue(buff[:n])
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons the datagrams of a UDP association are dropped.
+const (
+	UDPDropRead      = "read"
+	UDPDropDecode    = "decode"
+	UDPDropFragment  = "fragment"
+	UDPDropRule      = "rule"
+	UDPDropResolve   = "resolve"
+	UDPDropRateLimit = "rate_limit"
+	UDPDropQueueFull = "queue_full"
+	UDPDropFiltered  = "filtered"
+	UDPDropWrite     = "write"
+)
+
+// UDPStats is a snapshot of the statistics of a UDP association.
+type UDPStats struct {
+	UploadPackets   int64            `json:"upload_packets"`
+	DownloadPackets int64            `json:"download_packets"`
+	Drops           map[string]int64 `json:"drops,omitempty"`
+	NatEntries      int              `json:"nat_entries"`
+	NatEvictions    int64            `json:"nat_evictions"`
+	Destinations    int              `json:"destinations"`
+}
+
+// UDPMetrics is an optional interface of Metrics that receives the statistics
+// of the UDP associations. The NAT entries and the destination hosts are gauges
+// of all the associations, they are reported as changes.
+type UDPMetrics interface {
+	UDPDrop(ctx context.Context, reason string)
+	UDPNatEntries(ctx context.Context, delta int)
+	UDPDestinations(ctx context.Context, delta int)
+}
+
+// UDPNatMetrics is an optional interface of Metrics that receives
+// the evictions of the NAT mappings of the UDP associations.
+type UDPNatMetrics interface {
+	// UDPNatEviction receives the reason a mapping is evicted,
+	// one of the NatEviction constants.
+	UDPNatEviction(ctx context.Context, reason string)
+}
+
+func udpMetrics(m Metrics) UDPMetrics {
+	if udp, ok := m.(UDPMetrics); ok {
+		return udp
+	}
+
+	return &nopMetrics{}
+}
+
+func udpNatMetrics(m Metrics) UDPNatMetrics {
+	if nat, ok := m.(UDPNatMetrics); ok {
+		return nat
+	}
+
+	return &nopMetrics{}
+}
+
+func (m *nopMetrics) UDPDrop(_ context.Context, _ string)        {}
+func (m *nopMetrics) UDPNatEntries(_ context.Context, _ int)     {}
+func (m *nopMetrics) UDPDestinations(_ context.Context, _ int)   {}
+func (m *nopMetrics) UDPNatEviction(_ context.Context, _ string) {}
+
+// udpStats counts the datagrams of a UDP association.
+type udpStats struct {
+	upload    atomic.Int64
+	download  atomic.Int64
+	evictions atomic.Int64
+	nat       *natTable
+
+	mutex sync.Mutex
+	drops map[string]int64
+}
+
+func (st *udpStats) drop(reason string) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.drops == nil {
+		st.drops = make(map[string]int64)
+	}
+
+	st.drops[reason]++
+}
+
+func (st *udpStats) snapshot() *UDPStats {
+	stats := &UDPStats{
+		UploadPackets:   st.upload.Load(),
+		DownloadPackets: st.download.Load(),
+		NatEntries:      st.nat.len(),
+		NatEvictions:    st.evictions.Load(),
+		Destinations:    st.nat.hostsLen(),
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if len(st.drops) > 0 {
+		stats.Drops = make(map[string]int64, len(st.drops))
+		for reason, n := range st.drops {
+			stats.Drops[reason] = n
+		}
+	}
+
+	return stats
+}
+
+// tokenBucket allows a rate of events per second in bursts of up to
+// one second, it is used by a single goroutine.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		now:    time.Now,
+	}
+}
+
+// allow takes n tokens, an event larger than the burst is never allowed.
+func (b *tokenBucket) allow(n int) bool {
+	now := b.now()
+
+	if !b.last.IsZero() {
+		b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+
+	b.last = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+
+	return true
+}
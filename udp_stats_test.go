@@ -0,0 +1,31 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+
+	b := newTokenBucket(10)
+	b.now = func() time.Time { return now }
+
+	// The burst is one second of the rate.
+	assert.True(t, b.allow(6))
+	assert.True(t, b.allow(4))
+	assert.False(t, b.allow(1))
+
+	now = now.Add(300 * time.Millisecond)
+
+	assert.True(t, b.allow(3))
+	assert.False(t, b.allow(1))
+
+	// The tokens do not pile up past the burst.
+	now = now.Add(time.Hour)
+
+	assert.False(t, b.allow(11))
+	assert.True(t, b.allow(10))
+}
@@ -0,0 +1,189 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// UDPOverTCP is an extension command of this server for the clients that cannot
+// send UDP datagrams. The datagrams of the association are carried over the
+// control connection, every datagram is the SOCKS UDP request header followed
+// by the data, prefixed with its length as a 16-bit big-endian integer.
+// The destination of the request is ignored.
+const UDPOverTCP Command = 0xF2
+
+var errFrameTooLarge = errors.New("datagram is too large for a frame")
+
+// udpOverTCPHandler serves the UDPOverTCP command.
+func (s *Server) udpOverTCPHandler(ctx context.Context, req *Request, w ReplyWriter) {
+	sess := sessionFromContext(ctx)
+
+	packetConn, err := s.listenPacket(ctx, "udp", net.JoinHostPort(s.config.host, "0"))
+	if err != nil {
+		sess.close(CloseReasonListenError)
+
+		w.Reply(replyCodeFromError(err), "")
+
+		s.logger.Error(ctx, "error listen udp", LogKeyError, err)
+		return
+	}
+
+	conn := req.conn
+
+	association := s.newUDPAssociation(ctx, conn, packetConn)
+	association.relayConn = &framedPacketConn{Conn: conn, reader: conn.reader}
+	association.requests = make(chan []byte, udpRequestQueueSize)
+
+	// The client address only identifies the client in the mappings.
+	if client, err := net.ResolveUDPAddr("udp", conn.RemoteAddr().String()); err == nil {
+		association.client.Store(client)
+	}
+
+	conn.onClose(func() {
+		if err := packetConn.Close(); err != nil {
+			s.logger.Error(ctx, "error close udp listener", LogKeyError, err)
+		}
+	})
+
+	w.Reply(ReplySucceeded, s.relayAddress(conn, packetConn))
+
+	go association.readFrames()
+
+	// The stream carries datagrams of any size.
+	association.relay(0)
+}
+
+// readFrames queues the datagrams of the client sent over the control connection.
+func (a *udpAssociation) readFrames() {
+	defer a.conn.finish()
+
+	buff := make([]byte, math.MaxUint16)
+
+	for {
+		n, _, err := a.relayConn.ReadFrom(buff)
+		if err != nil {
+			return
+		}
+
+		select {
+		case a.requests <- append([]byte(nil), buff[:n]...):
+		case <-a.conn.done:
+			return
+		}
+	}
+}
+
+// framedPacketConn carries datagrams over a stream,
+// every datagram is prefixed with its length.
+type framedPacketConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *framedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	var length [2]byte
+
+	if _, err := io.ReadFull(c.reader, length[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if n > len(p) {
+		return 0, nil, io.ErrShortBuffer
+	}
+
+	if _, err := io.ReadFull(c.reader, p[:n]); err != nil {
+		return 0, nil, err
+	}
+
+	return n, c.RemoteAddr(), nil
+}
+
+func (c *framedPacketConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	if len(p) > math.MaxUint16 {
+		return 0, errFrameTooLarge
+	}
+
+	frame := make([]byte, 2, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+
+	if _, err := c.Conn.Write(append(frame, p...)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// NewUDPOverTCPConn returns the client side of a UDPOverTCP association on the
+// connection that received the successful reply. WriteTo sends a datagram to
+// the destination, a host:port with an IP address or a domain name, and
+// ReadFrom returns a datagram with the address of the remote host.
+func NewUDPOverTCPConn(conn net.Conn) net.PacketConn {
+	return &udpOverTCPConn{
+		framed: &framedPacketConn{Conn: conn, reader: conn},
+		buff:   make([]byte, math.MaxUint16),
+	}
+}
+
+type udpOverTCPConn struct {
+	framed *framedPacketConn
+	buff   []byte
+}
+
+func (c *udpOverTCPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, _, err := c.framed.ReadFrom(c.buff)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var datagram packet
+
+	if err := datagram.decode(c.buff[:n]); err != nil {
+		return 0, nil, err
+	}
+
+	var from net.Addr = domainAddr(datagram.address.String())
+
+	if datagram.address.IP != nil {
+		from = &net.UDPAddr{
+			IP:   datagram.address.IP,
+			Port: int(binary.BigEndian.Uint16(datagram.address.Port)),
+		}
+	}
+
+	return copy(p, datagram.payload), from, nil
+}
+
+func (c *udpOverTCPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	to, err := parseAddress(addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	datagram := packet{address: to}
+	datagram.encode(p)
+
+	if _, err := c.framed.WriteTo(datagram.payload, nil); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *udpOverTCPConn) Close() error                       { return c.framed.Close() }
+func (c *udpOverTCPConn) LocalAddr() net.Addr                { return c.framed.LocalAddr() }
+func (c *udpOverTCPConn) SetDeadline(t time.Time) error      { return c.framed.SetDeadline(t) }
+func (c *udpOverTCPConn) SetReadDeadline(t time.Time) error  { return c.framed.SetReadDeadline(t) }
+func (c *udpOverTCPConn) SetWriteDeadline(t time.Time) error { return c.framed.SetWriteDeadline(t) }
+
+// domainAddr is the address of a remote host known by its domain name,
+// the replies to a datagram sent to a domain name carry it.
+type domainAddr string
+
+func (a domainAddr) Network() string { return "udp" }
+func (a domainAddr) String() string  { return string(a) }
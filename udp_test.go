@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPacketConn is a socket every read of which fails.
+type failingPacketConn struct {
+	net.PacketConn
+	reads atomic.Int32
+}
+
+func (c *failingPacketConn) ReadFrom([]byte) (int, net.Addr, error) {
+	c.reads.Add(1)
+
+	return 0, nil, errors.New("read failure")
+}
+
+func TestUDPAssociationReadErrors(t *testing.T) {
+	s := New(WithLogger(NopLogger))
+
+	client, server := tcpPipe(t)
+	defer client.Close()
+	defer server.Close()
+
+	sess := newSession(server.RemoteAddr())
+	ctx := contextWithSession(context.Background(), sess)
+
+	packetConn := &failingPacketConn{}
+
+	a := s.newUDPAssociation(ctx, newConnection(server), packetConn)
+	a.relay(0)
+
+	assert.Equal(t, int32(udpMaxReadErrors), packetConn.reads.Load())
+	assert.Equal(t, CloseReasonRelayError, sess.closeReason)
+	assert.Equal(t, int64(udpMaxReadErrors), a.stats.snapshot().Drops[UDPDropRead])
+}
+
+func TestReadBackoff(t *testing.T) {
+	var backoff readBackoff
+
+	done := make(chan struct{})
+
+	for _, delay := range []time.Duration{udpReadRetryDelay, 2 * udpReadRetryDelay, 4 * udpReadRetryDelay} {
+		assert.True(t, backoff.wait(done))
+		assert.Equal(t, delay, backoff.delay)
+	}
+
+	backoff.delay = udpMaxReadRetryDelay
+
+	close(done)
+
+	// The wait ends with done, the delay does not grow past the maximum.
+	assert.False(t, backoff.wait(done))
+	assert.Equal(t, udpMaxReadRetryDelay, backoff.delay)
+
+	backoff.reset()
+	assert.Zero(t, backoff.delay)
+}